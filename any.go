@@ -0,0 +1,89 @@
+package protobuf
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// anyURLPrefix is the type URL prefix of messages packed by MarshalAny.
+const anyURLPrefix = "type.googleapis.com/"
+
+// Any holds an encoded message together with a type URL, which identifies
+// the message type. It has the layout of google.protobuf.Any.
+type Any struct {
+	TypeURL string `protobuf:"1"`
+	Value   []byte `protobuf:"2"`
+}
+
+// MessageName returns the full message name of the type URL, the part
+// after the last slash.
+func (a *Any) MessageName() string {
+	return a.TypeURL[strings.LastIndex(a.TypeURL, "/")+1:]
+}
+
+var (
+	anyTypes sync.Map // map[string]reflect.Type, message name to struct type
+	anyNames sync.Map // map[reflect.Type]string, struct type to message name
+)
+
+// RegisterName registers the struct type of v, a nil pointer to a struct,
+// under the full message name name, such as "example.Order". Messages of
+// registered types can be packed into and unpacked from an Any.
+//
+// RegisterName panics if v is not a pointer to a struct, or if the name
+// or the type is already registered.
+func RegisterName(name string, v interface{}) {
+	t := reflect.TypeOf(v)
+	if t == nil || t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		panic(fmt.Sprintf("protobuf: message type %T must be a pointer to a struct", v))
+	}
+	if name == "" || strings.Contains(name, "/") {
+		panic(fmt.Sprintf("protobuf: invalid message name %q", name))
+	}
+	t = t.Elem()
+
+	if _, dup := anyNames.Load(t); dup {
+		panic(fmt.Sprintf("protobuf: message type %s already registered", t))
+	}
+	if _, dup := anyTypes.LoadOrStore(name, t); dup {
+		panic(fmt.Sprintf("protobuf: message name %q already registered", name))
+	}
+	anyNames.Store(t, name)
+}
+
+// MarshalAny encodes v, a pointer to a struct of a registered type, and
+// packs it into an Any.
+func MarshalAny(v interface{}) (*Any, error) {
+	t := reflect.TypeOf(v)
+	if t == nil || t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		return nil, errors.New("v must be a pointer to a struct")
+	}
+	name, ok := anyNames.Load(t.Elem())
+	if !ok {
+		return nil, fmt.Errorf("unregistered message type %s", t.Elem())
+	}
+
+	data, err := Marshal(nil, v)
+	if err != nil {
+		return nil, err
+	}
+	return &Any{TypeURL: anyURLPrefix + name.(string), Value: data}, nil
+}
+
+// UnmarshalAny decodes the message packed into a and returns a pointer to
+// a new struct of the type registered for its message name.
+func UnmarshalAny(a *Any) (interface{}, error) {
+	t, ok := anyTypes.Load(a.MessageName())
+	if !ok {
+		return nil, fmt.Errorf("unregistered message name %q", a.MessageName())
+	}
+
+	v := reflect.New(t.(reflect.Type)).Interface()
+	if err := Unmarshal(a.Value, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
@@ -0,0 +1,127 @@
+package protobuf
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+	testproto "github.com/mars9/protobuf/internal/proto"
+)
+
+type anyNested struct {
+	Arg int32 `protobuf:"1"`
+}
+
+type anyMessage struct {
+	ID      uint64 `protobuf:"1"`
+	Payload *Any   `protobuf:"2"`
+}
+
+func init() {
+	RegisterName("proto.NestedStruct", (*anyNested)(nil))
+}
+
+func TestAnyEncode(t *testing.T) {
+	t.Parallel()
+
+	a, err := MarshalAny(&anyNested{Arg: 42})
+	if err != nil {
+		t.Fatalf("marshal any: %v", err)
+	}
+	if a.MessageName() != "proto.NestedStruct" {
+		t.Fatalf("any: expected message name %q, got %q", "proto.NestedStruct", a.MessageName())
+	}
+
+	data, err := Marshal(nil, a)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	pa := &any.Any{}
+	if err = proto.Unmarshal(data, pa); err != nil {
+		t.Fatalf("unmarshal protobuf: %v", err)
+	}
+	pm := &testproto.NestedStruct{}
+	if err = ptypes.UnmarshalAny(pa, pm); err != nil {
+		t.Fatalf("unmarshal protobuf any: %v", err)
+	}
+	if pm.Arg != 42 {
+		t.Fatalf("any: expected arg %d, got %d", 42, pm.Arg)
+	}
+
+	if pa, err = ptypes.MarshalAny(&testproto.NestedStruct{Arg: -1}); err != nil {
+		t.Fatalf("marshal protobuf any: %v", err)
+	}
+	pdata, err := proto.Marshal(pa)
+	if err != nil {
+		t.Fatalf("marshal protobuf: %v", err)
+	}
+	a = &Any{}
+	if err = Unmarshal(pdata, a); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	v, err := UnmarshalAny(a)
+	if err != nil {
+		t.Fatalf("unmarshal any: %v", err)
+	}
+	if expected := (&anyNested{Arg: -1}); !reflect.DeepEqual(expected, v) {
+		t.Fatalf("any: expected %#v, got %#v", expected, v)
+	}
+}
+
+func TestAnyField(t *testing.T) {
+	t.Parallel()
+
+	a, err := MarshalAny(&anyNested{Arg: 7})
+	if err != nil {
+		t.Fatalf("marshal any: %v", err)
+	}
+	v := &anyMessage{ID: 1, Payload: a}
+	data, err := Marshal(nil, v)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	m := &anyMessage{}
+	if err = Unmarshal(data, m); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(v, m) {
+		t.Fatalf("any field: expected %#v, got %#v", v, m)
+	}
+	payload, err := UnmarshalAny(m.Payload)
+	if err != nil {
+		t.Fatalf("unmarshal any: %v", err)
+	}
+	if expected := (&anyNested{Arg: 7}); !reflect.DeepEqual(expected, payload) {
+		t.Fatalf("any field: expected %#v, got %#v", expected, payload)
+	}
+}
+
+func TestAnyErrors(t *testing.T) {
+	t.Parallel()
+
+	if _, err := MarshalAny(&anyMessage{}); err == nil {
+		t.Fatalf("marshal unregistered any: expected error")
+	}
+	if _, err := UnmarshalAny(&Any{TypeURL: anyURLPrefix + "proto.Unknown"}); err == nil {
+		t.Fatalf("unmarshal unregistered any: expected error")
+	}
+
+	for _, f := range []func(){
+		func() { RegisterName("proto.NestedStruct", (*anyMessage)(nil)) },
+		func() { RegisterName("proto.Other", (*anyNested)(nil)) },
+		func() { RegisterName("", (*anyMessage)(nil)) },
+		func() { RegisterName("proto.Value", anyMessage{}) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("register name: expected panic")
+				}
+			}()
+			f()
+		}()
+	}
+}
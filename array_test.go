@@ -0,0 +1,109 @@
+package protobuf
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+type arrayMessage struct {
+	ID     [16]byte    `protobuf:"1"`
+	Vector [3]float64  `protobuf:"2"`
+	Counts [4]int32    `protobuf:"3,zigzag"`
+	Names  [2]string   `protobuf:"4"`
+	Items  [2]testItem `protobuf:"5"`
+	Hashes [2][4]byte  `protobuf:"6"`
+	Parent *[16]byte   `protobuf:"7"`
+}
+
+type sliceMessage struct {
+	ID     []byte     `protobuf:"1"`
+	Vector []float64  `protobuf:"2"`
+	Counts []int32    `protobuf:"3,zigzag"`
+	Names  []string   `protobuf:"4"`
+	Items  []testItem `protobuf:"5"`
+	Hashes [][]byte   `protobuf:"6"`
+	Parent []byte     `protobuf:"7"`
+}
+
+func TestArrayEncode(t *testing.T) {
+	t.Parallel()
+
+	parent := [16]byte{15: 1}
+	v := &arrayMessage{
+		ID:     [16]byte{0: 0xde, 1: 0xad, 15: 0xff},
+		Vector: [3]float64{1.5, 0, -2.5},
+		Counts: [4]int32{-1, 2},
+		Names:  [2]string{"a", "b"},
+		Items:  [2]testItem{{Sku: "x", Count: 1}, {}},
+		Hashes: [2][4]byte{{1, 2, 3, 4}, {}},
+		Parent: &parent,
+	}
+	s := &sliceMessage{
+		ID:     v.ID[:],
+		Vector: v.Vector[:],
+		Counts: v.Counts[:],
+		Names:  v.Names[:],
+		Items:  v.Items[:],
+		Hashes: [][]byte{{1, 2, 3, 4}, {0, 0, 0, 0}},
+		Parent: parent[:],
+	}
+
+	data, err := Marshal(nil, v)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	expected, err := Marshal(nil, s)
+	if err != nil {
+		t.Fatalf("marshal slices: %v", err)
+	}
+	if !bytes.Equal(expected, data) {
+		t.Fatalf("array encode: expected bytes %q, got %q", expected, data)
+	}
+	if n := sizeStruct(reflect.ValueOf(v).Elem()); n != len(data) {
+		t.Fatalf("array encode: expected size %d, got %d", len(data), n)
+	}
+
+	m := &arrayMessage{}
+	if err = Unmarshal(data, m); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(v, m) {
+		t.Fatalf("array decode: expected %#v, got %#v", v, m)
+	}
+
+	// scalar arrays with only zero elements are omitted, message arrays
+	// are always written
+	if data, err = Marshal(nil, &arrayMessage{}); err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if expected, err = Marshal(nil, &sliceMessage{Items: make([]testItem, 2)}); err != nil {
+		t.Fatalf("marshal slices: %v", err)
+	}
+	if !bytes.Equal(expected, data) {
+		t.Fatalf("zero arrays: expected bytes %q, got %q", expected, data)
+	}
+}
+
+func TestArrayDecodeErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, s := range []*sliceMessage{
+		{ID: make([]byte, 15)},
+		{ID: make([]byte, 17)},
+		{Vector: []float64{1, 2, 3, 4}},
+		{Counts: []int32{1, 2, 3, 4, 5}},
+		{Names: []string{"a", "b", "c"}},
+		{Items: []testItem{{}, {}, {}}},
+		{Hashes: [][]byte{{1, 2, 3}}},
+		{Parent: []byte{1}},
+	} {
+		data, err := Marshal(nil, s)
+		if err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+		if err = Unmarshal(data, &arrayMessage{}); err == nil {
+			t.Fatalf("unmarshal %#v: expected error", s)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/gob"
+	"encoding/hex"
 	"io"
 	"math"
 	"testing"
@@ -44,7 +45,7 @@ func init() {
 		if _, err := io.ReadFull(rand.Reader, benchSlice.Bytes[i]); err != nil {
 			panic("out of entropy")
 		}
-		benchSlice.String_[i] = string(benchSlice.Bytes[i])
+		benchSlice.String_[i] = hex.EncodeToString(benchSlice.Bytes[i])
 	}
 
 	//if err := encodedBuffer.Marshal(benchSlice); err != nil {
@@ -1,7 +1,6 @@
 package protobuf
 
 import (
-	"errors"
 	"io"
 	"sync"
 )
@@ -17,12 +16,12 @@ func readLength(r io.ByteReader, max int) (int, error) {
 		return 0, err
 	}
 	if size > maxInt {
-		return 0, errors.New("integer overflow")
+		return 0, ErrOverflow
 	}
 
 	msize := int(size)
 	if max > 0 && msize > max {
-		return 0, errors.New("message too large")
+		return 0, ErrTooLarge
 	}
 	return msize, nil
 }
@@ -32,7 +31,7 @@ func readLength(r io.ByteReader, max int) (int, error) {
 // message size is not checked.
 func writeLength(w io.ByteWriter, size, max int) error {
 	if max > 0 && size > max {
-		return errors.New("message too large")
+		return ErrTooLarge
 	}
 	return writeUvarint(w, uint64(size))
 }
@@ -48,7 +47,7 @@ func readUvarint(r io.ByteReader) (uint64, int, error) {
 
 		if b < 0x80 {
 			if n > 10 || n == 10 && b > 1 {
-				return v, n, errors.New("64-bit integer overflow")
+				return v, n, ErrOverflow
 			}
 			return v | uint64(b)<<shift, n, nil
 		}
@@ -66,6 +65,14 @@ func writeUvarint(w io.ByteWriter, v uint64) (err error) {
 	return w.WriteByte(byte(v))
 }
 
+func encodeZigZag(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
+
+func decodeZigZag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
+
 var (
 	pool64 = sync.Pool{New: func() interface{} { return [8]byte{} }}
 	pool32 = sync.Pool{New: func() interface{} { return [4]byte{} }}
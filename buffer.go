@@ -11,22 +11,40 @@ import (
 //
 // Marshal currently encodes all visible field, which does not allow
 // distinction between 'required' and 'optional' fields. Marshal ignores
-// unsupported struct field types.
+// fields of kinds without a Protocol Buffer type, such as channels and
+// functions, but fails for unsupported map, interface and Marshaler field
+// types.
 //
 // The returned slice may be a sub- slice of data if data was large
 // enough to hold the entire encoded block. Otherwise, a newly allocated
 // slice will be returned.
 func Marshal(data []byte, v interface{}) ([]byte, error) {
+	return MarshalOptions{}.Marshal(data, v)
+}
+
+// MarshalOptions configures the encoding of Marshal and Encoder.
+type MarshalOptions struct {
+	// Deterministic writes map entries ordered by key, so that equal
+	// values always produce the same bytes.
+	Deterministic bool
+
+	// AllowInvalidUTF8 writes strings that are not valid UTF-8, which
+	// proto3 string fields must hold, instead of failing with
+	// ErrInvalidUTF8.
+	AllowInvalidUTF8 bool
+}
+
+// Marshal is like the package level Marshal, but uses the options o.
+func (o MarshalOptions) Marshal(data []byte, v interface{}) ([]byte, error) {
 	val := reflect.ValueOf(v)
 	if val.Kind() != reflect.Ptr || val.Elem().Kind() != reflect.Struct {
 		return data, errors.New("v must be a pointer to a struct")
 	}
 
-	val = val.Elem()
-	fields := val.NumField()
 	b := buffer(data)
 	enc := NewEncoder(&b, 0)
-	if err := enc.encodeStruct(val, fields); err != nil {
+	enc.SetOptions(o)
+	if err := enc.encodeStruct(val.Elem()); err != nil {
 		return nil, err
 	}
 	return b, nil
@@ -37,17 +55,10 @@ func Marshal(data []byte, v interface{}) ([]byte, error) {
 // data, the results can be unpredictable.
 //
 // Unmarshal uses the inverse of the encodings that Marshal uses,
-// allocating slices and pointers as necessary.
+// allocating slices and pointers as necessary. The struct underlying v is
+// reset first; use UnmarshalMerge to merge into its current value.
 func Unmarshal(data []byte, v interface{}) error {
-	val := reflect.ValueOf(v)
-	if !val.IsValid() || val.IsNil() {
-		return nil
-	}
-	if val.Kind() != reflect.Ptr || val.Elem().Kind() != reflect.Struct {
-		return errors.New("v must be a pointer to a struct")
-	}
-
-	return decodeStruct(val.Elem(), data, false)
+	return UnmarshalOptions{}.Unmarshal(data, v)
 }
 
 // UnmarshalUnsafe parses the protocol buffer representation in data and
@@ -60,6 +71,76 @@ func Unmarshal(data []byte, v interface{}) error {
 // UnmarshalUnsafe does not copy raw byte slices. Most code should use
 // Unmarshal instead.
 func UnmarshalUnsafe(data []byte, v interface{}) error {
+	return UnmarshalOptions{}.unmarshal(data, v, true)
+}
+
+// UnmarshalMerge is like Unmarshal, but merges the decoded fields into the
+// current value of the struct underlying v, as described for
+// UnmarshalOptions.Merge.
+func UnmarshalMerge(data []byte, v interface{}) error {
+	return UnmarshalOptions{Merge: true}.Unmarshal(data, v)
+}
+
+// Merge merges the struct underlying src into the struct underlying dst,
+// which must be pointers to the same struct type. It follows the rules of
+// UnmarshalOptions.Merge, as if src was marshaled and then unmarshaled
+// into dst; fields of src with the zero value are not merged.
+func Merge(dst, src interface{}) error {
+	if reflect.TypeOf(dst) != reflect.TypeOf(src) {
+		return errors.New("dst and src must have the same type")
+	}
+	data, err := MarshalOptions{AllowInvalidUTF8: true}.Marshal(nil, src)
+	if err != nil {
+		return err
+	}
+	return UnmarshalOptions{Merge: true, AllowInvalidUTF8: true}.Unmarshal(data, dst)
+}
+
+// UnmarshalOptions configures the decoding of Unmarshal and Decoder.
+//
+// The limits protect against hostile input, which would otherwise exhaust
+// the stack or memory. Exceeding a limit fails with an error wrapping
+// ErrLimit.
+type UnmarshalOptions struct {
+	// MaxDepth limits the nesting depth of messages, including map
+	// entries and well-known types. If 0, a depth of 10000 is allowed.
+	MaxDepth int
+
+	// MaxElements limits the number of elements of each repeated and map
+	// field. If 0, the element count is not checked.
+	MaxElements int
+
+	// MaxBytes limits the approximate number of bytes allocated for
+	// strings, byte slices, messages and repeated elements, and by
+	// Decoder for the message data. If 0, allocations are not checked.
+	MaxBytes int
+
+	// Strict rejects fields whose wire type does not match the Go field,
+	// including groups, and bools that are not encoded as a single 0 or 1
+	// byte. Otherwise such fields are skipped or decoded leniently.
+	// Trailing garbage, that is data after the last field that does not
+	// form a complete field, is rejected in either mode.
+	Strict bool
+
+	// AllowInvalidUTF8 accepts strings that are not valid UTF-8 instead
+	// of failing with ErrInvalidUTF8.
+	AllowInvalidUTF8 bool
+
+	// Merge merges the decoded fields into the current value of the
+	// target instead of resetting it first. Scalars, strings, bytes,
+	// times, durations and wrappers are replaced, repeated fields and
+	// lists are appended to, and nested messages, oneof messages of the
+	// same case, maps and objects are merged recursively, where map
+	// entries replace values with the same key.
+	Merge bool
+}
+
+// Unmarshal is like the package level Unmarshal, but uses the options o.
+func (o UnmarshalOptions) Unmarshal(data []byte, v interface{}) error {
+	return o.unmarshal(data, v, false)
+}
+
+func (o UnmarshalOptions) unmarshal(data []byte, v interface{}, unsafe bool) error {
 	val := reflect.ValueOf(v)
 	if !val.IsValid() || val.IsNil() {
 		return nil
@@ -68,7 +149,11 @@ func UnmarshalUnsafe(data []byte, v interface{}) error {
 		return errors.New("v must be a pointer to a struct")
 	}
 
-	return decodeStruct(val.Elem(), data, true)
+	if !o.Merge {
+		val.Elem().Set(reflect.Zero(val.Elem().Type()))
+	}
+	s := &decodeState{opts: o, unsafe: unsafe}
+	return rootError(val.Type().Elem(), decodeStruct(val.Elem(), data, s))
 }
 
 type buffer []byte
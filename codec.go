@@ -0,0 +1,146 @@
+package protobuf
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Wire types of values encoded by a Codec.
+const (
+	WireVarint  = wireVarint
+	WireFixed64 = wireFixed64
+	WireBytes   = wireBytes
+	WireFixed32 = wireFixed32
+)
+
+// Codec encodes and decodes values of a type registered with
+// RegisterType.
+type Codec interface {
+	// WireType returns the wire type of the encoded values, one of
+	// WireVarint, WireFixed64, WireBytes or WireFixed32.
+	WireType() int
+
+	// Size returns the length of the encoding of v, without field key
+	// and, for WireBytes, without length prefix.
+	Size(v reflect.Value) int
+
+	// Marshal appends the encoding of v to b and returns the extended
+	// buffer. The encoding must be Size(v) bytes long.
+	Marshal(b []byte, v reflect.Value) ([]byte, error)
+
+	// Unmarshal decodes data, a value as written by Marshal, into the
+	// settable v. Data aliases the input of the decoder, so Unmarshal
+	// must copy the data if it wishes to retain the data after returning.
+	Unmarshal(data []byte, v reflect.Value) error
+}
+
+var codecRegistry sync.Map // map[reflect.Type]Codec
+
+// RegisterType registers the codec c for values of the type t, which
+// then take precedence over the built-in encoding of t. The codec is used
+// for struct fields of type t, *t and []t, oneof cases and map values.
+// Zero values of t are not encoded, unless they are map values or held by
+// a non-nil pointer.
+//
+// RegisterType must be called before a struct with a field of type t is
+// encoded or decoded for the first time, typically in an init function.
+// It panics if t is already registered or c has an invalid wire type.
+func RegisterType(t reflect.Type, c Codec) {
+	if t == nil || c == nil {
+		panic("protobuf: RegisterType with nil type or codec")
+	}
+	switch c.WireType() {
+	case wireVarint, wireFixed64, wireBytes, wireFixed32:
+	default:
+		panic(fmt.Sprintf("protobuf: codec of %s has invalid wire type %d", t, c.WireType()))
+	}
+	if _, dup := codecRegistry.LoadOrStore(t, c); dup {
+		panic(fmt.Sprintf("protobuf: type %s already registered", t))
+	}
+}
+
+// lookupCodec returns the codec registered for the type t or nil.
+func lookupCodec(t reflect.Type) Codec {
+	if c, ok := codecRegistry.Load(t); ok {
+		return c.(Codec)
+	}
+	return nil
+}
+
+// fieldCodec returns the codec of the type t, if t is a registered type
+// or a pointer to or slice of a registered type.
+func fieldCodec(t reflect.Type) Codec {
+	if c := lookupCodec(t); c != nil {
+		return c
+	}
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice:
+		return lookupCodec(t.Elem())
+	}
+	return nil
+}
+
+// isZeroValue reports whether val is the zero value of its type.
+func isZeroValue(val reflect.Value) bool {
+	switch val.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map, reflect.Func, reflect.Chan:
+		return val.IsNil()
+	}
+	return reflect.DeepEqual(val.Interface(), reflect.Zero(val.Type()).Interface())
+}
+
+// sizeCodec returns the encoded size of the value val of the codec c
+// including its key.
+func sizeCodec(key int, c Codec, val reflect.Value) int {
+	m := c.Size(val)
+	if c.WireType() == wireBytes {
+		m += uvarintSize(uint64(m))
+	}
+	return sizeKey(key) + m
+}
+
+func (e *Encoder) writeCodec(key int, c Codec, val reflect.Value) error {
+	b, err := c.Marshal(nil, val)
+	if err != nil {
+		return err
+	}
+	if len(b) != c.Size(val) {
+		return fmt.Errorf("codec of %s: marshaled %d bytes, size is %d", val.Type(), len(b), c.Size(val))
+	}
+
+	wire := c.WireType()
+	if err = e.writeKey(key, wire); err != nil {
+		return err
+	}
+	if wire == wireBytes {
+		if err = writeUvarint(e.w, uint64(len(b))); err != nil {
+			return err
+		}
+	}
+	_, err = e.w.Write(b)
+	return err
+}
+
+// decodeCodec decodes the value data of the codec c into val, which is
+// of the registered type, a pointer to it, which is allocated if nil, or
+// a slice of it, to which the value is appended.
+func decodeCodec(val reflect.Value, c Codec, data []byte) error {
+	if lookupCodec(val.Type()) != nil {
+		return c.Unmarshal(data, val)
+	}
+	switch val.Kind() {
+	case reflect.Ptr:
+		if val.IsNil() {
+			val.Set(reflect.New(val.Type().Elem()))
+		}
+		return c.Unmarshal(data, val.Elem())
+	case reflect.Slice:
+		elem := reflect.New(val.Type().Elem()).Elem()
+		if err := c.Unmarshal(data, elem); err != nil {
+			return err
+		}
+		val.Set(reflect.Append(val, elem))
+	}
+	return nil
+}
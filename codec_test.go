@@ -0,0 +1,139 @@
+package protobuf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"reflect"
+	"testing"
+)
+
+// testID is encoded as 8 byte big-endian bytes.
+type testID uint64
+
+type testIDCodec struct{}
+
+func (testIDCodec) WireType() int            { return WireBytes }
+func (testIDCodec) Size(v reflect.Value) int { return 8 }
+
+func (testIDCodec) Marshal(b []byte, v reflect.Value) ([]byte, error) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v.Uint())
+	return append(b, buf[:]...), nil
+}
+
+func (testIDCodec) Unmarshal(data []byte, v reflect.Value) error {
+	if len(data) != 8 {
+		return errors.New("invalid id length")
+	}
+	v.SetUint(binary.BigEndian.Uint64(data))
+	return nil
+}
+
+// bigIntCodec encodes *big.Int values as ZigZag varints.
+type bigIntCodec struct{}
+
+func (bigIntCodec) WireType() int { return WireVarint }
+
+func (bigIntCodec) Size(v reflect.Value) int {
+	return uvarintSize(encodeZigZag(v.Interface().(*big.Int).Int64()))
+}
+
+func (bigIntCodec) Marshal(b []byte, v reflect.Value) ([]byte, error) {
+	x := v.Interface().(*big.Int)
+	if !x.IsInt64() {
+		return nil, errors.New("big int overflow")
+	}
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], encodeZigZag(x.Int64()))
+	return append(b, buf[:n]...), nil
+}
+
+func (bigIntCodec) Unmarshal(data []byte, v reflect.Value) error {
+	u, n := binary.Uvarint(data)
+	if n <= 0 {
+		return errors.New("bad varint value")
+	}
+	v.Set(reflect.ValueOf(big.NewInt(decodeZigZag(u))))
+	return nil
+}
+
+func init() {
+	RegisterType(reflect.TypeOf(testID(0)), testIDCodec{})
+	RegisterType(reflect.TypeOf((*big.Int)(nil)), bigIntCodec{})
+}
+
+type codecMessage struct {
+	ID     testID            `protobuf:"1"`
+	Parent *testID           `protobuf:"2"`
+	Refs   []testID          `protobuf:"3"`
+	Owners map[string]testID `protobuf:"4"`
+	Amount *big.Int          `protobuf:"5"`
+	Deltas []*big.Int        `protobuf:"6"`
+}
+
+func TestCodecEncode(t *testing.T) {
+	t.Parallel()
+
+	parent := testID(0)
+	v := &codecMessage{
+		ID:     0x0102030405060708,
+		Parent: &parent,
+		Refs:   []testID{1, 0},
+		Owners: map[string]testID{"a": 3},
+		Amount: big.NewInt(-5),
+		Deltas: []*big.Int{big.NewInt(0), big.NewInt(1 << 40)},
+	}
+
+	data, err := Marshal(nil, v)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if n := sizeStruct(reflect.ValueOf(v).Elem()); n != len(data) {
+		t.Fatalf("codec: expected size %d, got %d", len(data), n)
+	}
+	expected := []byte{1<<3 | wireBytes, 8, 1, 2, 3, 4, 5, 6, 7, 8}
+	if !bytes.HasPrefix(data, expected) {
+		t.Fatalf("codec: expected prefix %v, got %v", expected, data)
+	}
+
+	m := &codecMessage{}
+	if err = Unmarshal(data, m); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(v, m) {
+		t.Fatalf("codec: expected %#v, got %#v", v, m)
+	}
+
+	if data, err = Marshal(nil, &codecMessage{}); err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if len(data) != 0 {
+		t.Fatalf("zero codec values: expected no bytes, got %v", data)
+	}
+}
+
+func TestCodecErrors(t *testing.T) {
+	t.Parallel()
+
+	x := new(big.Int).Lsh(big.NewInt(1), 70)
+	if _, err := Marshal(nil, &codecMessage{Amount: x}); err == nil {
+		t.Fatalf("marshal codec error: expected error")
+	}
+	data := []byte{1<<3 | wireBytes, 2, 1, 2}
+	if err := Unmarshal(data, &codecMessage{}); err == nil {
+		t.Fatalf("unmarshal %v: expected error", data)
+	}
+	data = []byte{1<<3 | wireVarint, 1}
+	if err := (UnmarshalOptions{Strict: true}).Unmarshal(data, &codecMessage{}); !errors.Is(err, ErrInvalidWireType) {
+		t.Fatalf("unmarshal %v: expected ErrInvalidWireType, got %v", data, err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("register type: expected panic")
+		}
+	}()
+	RegisterType(reflect.TypeOf(testID(0)), testIDCodec{})
+}
@@ -1,13 +1,16 @@
 package protobuf
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"math"
 	"reflect"
 	"time"
+	"unicode/utf8"
 )
 
 // Reader defines the decode reader. Typically this is a *bufio.Reader.
@@ -19,8 +22,9 @@ type Reader interface {
 // Decoder manages the receipt of type and data information read from the
 // remote side of a connection.
 type Decoder struct {
-	r   Reader
-	max int
+	r    Reader
+	max  int
+	opts UnmarshalOptions
 }
 
 // NewDecoder returns a new decoder that reads from the io.Reader.
@@ -31,11 +35,17 @@ func NewDecoder(r Reader, max int) *Decoder {
 	return &Decoder{r: r, max: max}
 }
 
+// SetOptions sets the options used by subsequent calls to Decode.
+func (d *Decoder) SetOptions(opts UnmarshalOptions) {
+	d.opts = opts
+}
+
 // Decode first reads the varint encoded message size and then reads
 // the next value from the input stream and stores it in the data
 // represented by the empty interface value. If v is nil, the value will
 // be discarded. Otherwise, the value underlying v must be a pointer to
-// the correct type for the next data item received.
+// the correct type for the next data item received. The value is reset
+// first, unless the Merge option is set.
 func (d *Decoder) Decode(v interface{}) error {
 	val := reflect.ValueOf(v)
 	if !val.IsValid() || val.IsNil() {
@@ -49,11 +59,18 @@ func (d *Decoder) Decode(v interface{}) error {
 	if err != nil {
 		return err
 	}
-	data := make([]byte, size)
-	if _, err = io.ReadFull(d.r, data); err != nil {
+	s := &decodeState{opts: d.opts, unsafe: true}
+	if err = s.alloc(size); err != nil {
+		return err
+	}
+	data, err := readBody(d.r, size)
+	if err != nil {
 		return err
 	}
-	return decodeStruct(val.Elem(), data, true)
+	if !d.opts.Merge {
+		val.Elem().Set(reflect.Zero(val.Elem().Type()))
+	}
+	return rootError(val.Type().Elem(), decodeStruct(val.Elem(), data, s))
 }
 
 // Reset discards any buffered data, resets all state, and switches the
@@ -63,6 +80,22 @@ func (d *Decoder) Reset(r Reader, max int) {
 	d.r = r
 }
 
+// readBody reads a message of size bytes from r. The buffer grows as data
+// arrives, so a bogus size prefix cannot allocate more than the input.
+func readBody(r io.Reader, size int) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if size <= bytes.MinRead {
+		buf.Grow(size)
+	}
+	if _, err := io.CopyN(buf, r, int64(size)); err != nil {
+		if err == io.EOF {
+			return nil, ErrTruncated
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 func (d *Decoder) decodeNil() error {
 	size, err := readLength(d.r, d.max)
 	if err != nil {
@@ -83,96 +116,478 @@ func (d *Decoder) decodeNil() error {
 	return nil
 }
 
-func decodeStruct(val reflect.Value, data []byte, unsafe bool) error {
-	fields, size := val.NumField(), len(data)
-	var field reflect.Value
-	var err error
-	for off := 0; off < size && err == nil; {
+// defaultMaxDepth is the nesting depth limit used if
+// UnmarshalOptions.MaxDepth is 0.
+const defaultMaxDepth = 10000
+
+// decodeState holds the options and the resources used by a single
+// Decode or Unmarshal call.
+type decodeState struct {
+	opts   UnmarshalOptions
+	unsafe bool // alias byte slices of the input data
+	depth  int  // current message nesting depth
+	bytes  int  // bytes allocated so far
+}
+
+// enter increments the message nesting depth. The caller must call leave
+// if enter succeeds.
+func (s *decodeState) enter() error {
+	max := s.opts.MaxDepth
+	if max == 0 {
+		max = defaultMaxDepth
+	}
+	if s.depth >= max {
+		return fmt.Errorf("%w: nesting depth exceeds %d", ErrLimit, max)
+	}
+	s.depth++
+	return nil
+}
+
+func (s *decodeState) leave() {
+	s.depth--
+}
+
+// alloc accounts for n allocated bytes.
+func (s *decodeState) alloc(n int) error {
+	s.bytes += n
+	if max := s.opts.MaxBytes; max > 0 && s.bytes > max {
+		return fmt.Errorf("%w: allocation exceeds %d bytes", ErrLimit, max)
+	}
+	return nil
+}
+
+// checkUTF8 checks that the string data v is valid UTF-8, unless invalid
+// strings are allowed.
+func (s *decodeState) checkUTF8(v []byte) error {
+	if !s.opts.AllowInvalidUTF8 && !utf8.Valid(v) {
+		return ErrInvalidUTF8
+	}
+	return nil
+}
+
+// elements checks the number of elements of the slice or map val.
+func (s *decodeState) elements(val reflect.Value) error {
+	if max := s.opts.MaxElements; max > 0 && val.Len() > max {
+		return fmt.Errorf("%w: more than %d elements", ErrLimit, max)
+	}
+	return nil
+}
+
+// grow checks the slice or map val, which had n elements before, and
+// accounts for the added elements.
+func (s *decodeState) grow(val reflect.Value, n int) error {
+	if err := s.elements(val); err != nil {
+		return err
+	}
+	size := val.Type().Elem().Size()
+	if val.Kind() == reflect.Map {
+		size += val.Type().Key().Size()
+	}
+	return s.alloc((val.Len() - n) * int(size))
+}
+
+func decodeStruct(val reflect.Value, data []byte, s *decodeState) error {
+	if err := s.enter(); err != nil {
+		return err
+	}
+	defer s.leave()
+
+	info := getStructInfo(val.Type())
+	if info.unmarshaler {
+		return val.Addr().Interface().(Unmarshaler).UnmarshalProtobuf(data)
+	}
+	if info.err != nil {
+		return info.err
+	}
+
+	var arrays map[int]reflect.Value // array field index to decoded elements
+	for off := 0; off < len(data); {
+		start := off
 		key, n := binary.Uvarint(data[off:])
 		if n <= 0 {
-			return errors.New("invalid field key")
+			return &DecodeError{Offset: start, Err: uvarintError(n)}
 		}
 		off += n
 
-		fnum := int(key >> 3)
-		if fnum > 0 && fnum <= fields {
-			field = val.Field(fnum - 1)
-		} else {
-			break
+		fnum, wire := key>>3, key&7
+		if fnum == 0 || fnum > maxFieldNumber {
+			return &DecodeError{Offset: start, Field: int(fnum), Wire: int(wire),
+				Err: errors.New("invalid field number")}
+		}
+		f := info.lookup(int(fnum))
+		if f == nil || !s.opts.Strict && (wire != wireVarint && wire != wireFixed64 &&
+			wire != wireBytes && wire != wireFixed32 || !codecWire(val.Type(), f, wire)) {
+			n, err := skipField(data[off:], fnum, wire)
+			if err != nil {
+				return &DecodeError{Offset: start, Field: int(fnum), Wire: int(wire), Err: err}
+			}
+			off += n
+			if err = keepUnknown(val, info, data[start:off], s); err != nil {
+				return &DecodeError{Offset: start, Field: int(fnum), Wire: int(wire), Err: err}
+			}
+			continue
 		}
 
-		switch key & 7 {
-		case wireVarint:
-			v, n := binary.Uvarint(data[off:])
-			if n <= 0 {
-				return errors.New("bad varint value")
+		field := val.Field(f.index)
+		if f.wrapper != nil {
+			field = oneofField(field, f)
+		}
+		array := field.Kind() == reflect.Array && field.Type().Elem().Kind() != reflect.Uint8
+		if array {
+			if arrays == nil {
+				arrays = make(map[int]reflect.Value)
 			}
-			if err = decodeUvarint(field, v); err != nil {
-				return err
+			if _, ok := arrays[f.index]; !ok {
+				arrays[f.index] = reflect.New(reflect.SliceOf(field.Type().Elem())).Elem()
+			}
+			field = arrays[f.index]
+		}
+		index, count := -1, -1 // slice index and length before decoding
+		switch {
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() != reflect.Uint8:
+			index, count = field.Len(), field.Len()
+		case field.Kind() == reflect.Map:
+			count = field.Len()
+		}
+
+		n, err := decodeField(field, f, data[off:], wire, s)
+		if err == nil && count >= 0 {
+			err = s.grow(field, count)
+		}
+		if err == nil && array && field.Len() > val.Field(f.index).Len() {
+			err = fmt.Errorf("too many elements for array of length %d", val.Field(f.index).Len())
+		}
+		if err != nil {
+			return fieldError(err, f, index, start, off, fnum, wire)
+		}
+		off += n
+	}
+
+	for i, elems := range arrays {
+		reflect.Copy(val.Field(i), elems)
+	}
+	return nil
+}
+
+// codecWire reports whether the wire type wire matches the codec of the
+// field f of the struct type t. Fields without a codec always match.
+func codecWire(t reflect.Type, f *fieldInfo, wire uint64) bool {
+	ft := t.Field(f.index).Type
+	if f.wrapper != nil {
+		ft = f.wrapper.Elem().Field(f.inner).Type
+	}
+	c := fieldCodec(ft)
+	return c == nil || wire == uint64(c.WireType())
+}
+
+// decodeField decodes the value with the wire type wire at the beginning
+// of data into the field f and returns its length. The offset of a
+// *DecodeError of a nested message is relative to data.
+func decodeField(field reflect.Value, f *fieldInfo, data []byte, wire uint64, s *decodeState) (int, error) {
+	if c := fieldCodec(field.Type()); c != nil {
+		if wire != uint64(c.WireType()) {
+			return 0, fmt.Errorf("%w: codec expects wire type %d", ErrInvalidWireType, c.WireType())
+		}
+		n, err := skipField(data, 0, wire)
+		if err != nil {
+			return 0, err
+		}
+		v := data[:n]
+		if wire == wireBytes {
+			_, m := binary.Uvarint(v)
+			v = v[m:]
+		}
+		return n, decodeCodec(field, c, v)
+	}
+	if s.opts.Strict && !validWire(field.Type(), f, wire) {
+		return 0, fmt.Errorf("%w: %d for %s", ErrInvalidWireType, wire, field.Type())
+	}
+
+	switch wire {
+	case wireVarint:
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			return 0, uvarintError(n)
+		}
+		if s.opts.Strict && n > 1 && isBool(field.Type()) {
+			return 0, errBoolEncoding
+		}
+		if f.zigzag {
+			v = uint64(decodeZigZag(v))
+		}
+		return n, decodeUvarint(field, v)
+	case wireFixed32:
+		if len(data) < 4 {
+			return 0, ErrTruncated
+		}
+		return 4, decodeFixed32(field, binary.LittleEndian.Uint32(data))
+	case wireFixed64:
+		if len(data) < 8 {
+			return 0, ErrTruncated
+		}
+		return 8, decodeFixed64(field, binary.LittleEndian.Uint64(data))
+	}
+
+	v, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, uvarintError(n)
+	}
+	if v > uint64(len(data)-n) {
+		return 0, ErrTruncated
+	}
+	m := int(v)
+	payload := data[n : n+m]
+
+	var err error
+	if f.wrapped {
+		err = decodeWrapped(field, payload, s)
+	} else if field.Kind() == reflect.Slice && field.Type().Elem() != durationType &&
+		packable(field.Type().Elem().Kind()) {
+		err = decodePacked(field, payload, f, s)
+	} else {
+		err = decodeBytes(field, payload, s)
+	}
+	if de, ok := err.(*DecodeError); ok {
+		de.Offset += n
+	}
+	return n + m, err
+}
+
+// errBoolEncoding is returned in strict mode for bools that are not
+// encoded as a single 0 or 1 byte.
+var errBoolEncoding = errors.New("invalid bool encoding")
+
+// isBool reports whether t is a bool or a pointer, slice or array of
+// bools.
+func isBool(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Bool
+}
+
+// validWire reports whether the wire type wire is used by the encoding of
+// fields of type t with the options of f. Scalar slices accept packed and
+// unpacked elements.
+func validWire(t reflect.Type, f *fieldInfo, wire uint64) bool {
+	switch {
+	case f.wrapped:
+		return wire == wireBytes
+	case t == timeType && f.unixnano:
+		return wire == wireVarint
+	case t == durationType:
+		return wire == wireBytes
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return validWire(t.Elem(), f, wire)
+	case reflect.Slice, reflect.Array:
+		elem := t.Elem()
+		if elem.Kind() == reflect.Uint8 {
+			return wire == wireBytes
+		}
+		if wire == wireBytes && elem != durationType && packable(elem.Kind()) {
+			return true
+		}
+		return validWire(elem, f, wire)
+	}
+	return wire == scalarWire(t.Kind(), f)
+}
+
+// scalarWire returns the wire type of a value of the given kind, which is
+// wireBytes for all non-scalar kinds.
+func scalarWire(kind reflect.Kind, f *fieldInfo) uint64 {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if !f.fixed {
+			return wireVarint
+		}
+		if fixedSize(kind) == 4 {
+			return wireFixed32
+		}
+		return wireFixed64
+	case reflect.Bool:
+		return wireVarint
+	case reflect.Float32:
+		return wireFixed32
+	case reflect.Float64:
+		return wireFixed64
+	}
+	return wireBytes
+}
+
+// keepUnknown appends the raw field data to the unknown fields of val, if
+// the struct has any.
+func keepUnknown(val reflect.Value, info *structInfo, data []byte, s *decodeState) error {
+	if info.unknown < 0 {
+		return nil
+	}
+	if err := s.alloc(len(data)); err != nil {
+		return err
+	}
+	field := val.Field(info.unknown)
+	field.SetBytes(append(field.Bytes(), data...))
+	return nil
+}
+
+// skipField returns the length of the value with the wire type wire at
+// the beginning of data. A group is skipped up to and including the end
+// group key of the field number num. Nested groups are skipped without
+// recursion.
+func skipField(data []byte, num, wire uint64) (int, error) {
+	switch wire {
+	case wireVarint:
+		_, n := binary.Uvarint(data)
+		if n <= 0 {
+			return 0, uvarintError(n)
+		}
+		return n, nil
+	case wireFixed32:
+		if len(data) < 4 {
+			return 0, ErrTruncated
+		}
+		return 4, nil
+	case wireFixed64:
+		if len(data) < 8 {
+			return 0, ErrTruncated
+		}
+		return 8, nil
+	case wireBytes:
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			return 0, uvarintError(n)
+		}
+		if v > uint64(len(data)-n) {
+			return 0, ErrTruncated
+		}
+		return n + int(v), nil
+	case wireStartGroup:
+		groups := []uint64{num} // field numbers of the open groups
+		for off := 0; ; {
+			key, n := binary.Uvarint(data[off:])
+			if n <= 0 {
+				return 0, uvarintError(n)
 			}
 			off += n
-		case wireFixed32:
-			if off+4 >= size {
-				return errors.New("bad 32-bit value")
+
+			switch key & 7 {
+			case wireStartGroup:
+				groups = append(groups, key>>3)
+			case wireEndGroup:
+				if key>>3 != groups[len(groups)-1] {
+					return 0, errors.New("mismatched end group")
+				}
+				if groups = groups[:len(groups)-1]; len(groups) == 0 {
+					return off, nil
+				}
+			default:
+				m, err := skipField(data[off:], key>>3, key&7)
+				if err != nil {
+					return 0, err
+				}
+				off += m
 			}
-			v := binary.LittleEndian.Uint32(data[off:])
-			if err = decodeFixed32(field, v); err != nil {
+		}
+	case wireEndGroup:
+		return 0, fmt.Errorf("%w: unexpected end group", ErrInvalidWireType)
+	}
+	return 0, ErrInvalidWireType
+}
+
+// oneofField returns the value field of the oneof case f held by the
+// interface val. A new wrapper is allocated, if val holds another case.
+func oneofField(val reflect.Value, f *fieldInfo) reflect.Value {
+	if val.IsNil() || val.Elem().Type() != f.wrapper {
+		val.Set(reflect.New(f.wrapper.Elem()))
+	}
+	return val.Elem().Elem().Field(f.inner)
+}
+
+// decodePacked appends the packed scalar elements in data to the slice
+// val.
+func decodePacked(val reflect.Value, data []byte, f *fieldInfo, s *decodeState) error {
+	kind := val.Type().Elem().Kind()
+	for off := 0; off < len(data); {
+		if err := s.elements(val); err != nil {
+			return err
+		}
+		switch {
+		case kind == reflect.Float32 || f.fixed && fixedSize(kind) == 4:
+			if off+4 > len(data) {
+				return ErrTruncated
+			}
+			if err := decodeFixed32(val, binary.LittleEndian.Uint32(data[off:])); err != nil {
 				return err
 			}
 			off += 4
-		case wireFixed64:
-			if off+8 >= size {
-				return errors.New("bad 64-bit value")
+		case kind == reflect.Float64 || f.fixed:
+			if off+8 > len(data) {
+				return ErrTruncated
 			}
-			v := binary.LittleEndian.Uint64(data[off:])
-			if err = decodeFixed64(field, v); err != nil {
+			if err := decodeFixed64(val, binary.LittleEndian.Uint64(data[off:])); err != nil {
 				return err
 			}
 			off += 8
-		case wireBytes:
+		default:
 			v, n := binary.Uvarint(data[off:])
 			if n <= 0 {
-				return errors.New("bad varint size value")
+				return uvarintError(n)
 			}
-			m := int(v)
-			off += n
-			err = decodeBytes(field, data[off:off+m], unsafe)
-			if err != nil {
+			if s.opts.Strict && n > 1 && kind == reflect.Bool {
+				return errBoolEncoding
+			}
+			if f.zigzag {
+				v = uint64(decodeZigZag(v))
+			}
+			if err := decodeUvarint(val, v); err != nil {
 				return err
 			}
-			off += m
+			off += n
 		}
 	}
-	return err
+	return nil
 }
 
 var errorType = reflect.TypeOf((*error)(nil)).Elem()
 
-func decodeError(val reflect.Value, v []byte) (bool, error) {
+func decodeError(val reflect.Value, v []byte, s *decodeState) (bool, error) {
 	if _, ok := val.Interface().(error); ok || val.Type() == errorType {
+		if err := s.checkUTF8(v); err != nil {
+			return true, err
+		}
 		val.Set(reflect.ValueOf(errors.New(string(v))))
 		return true, nil
 	}
 	return false, nil
 }
 
-func decodeBytes(val reflect.Value, v []byte, unsafe bool) error {
-	custom, err := decodeError(val, v)
+func decodeBytes(val reflect.Value, v []byte, s *decodeState) error {
+	if isValueTree(val.Type()) {
+		return decodeValueTree(val, v, s)
+	}
+	custom, err := decodeError(val, v, s)
 	if custom {
 		return err
 	}
+	switch val.Type() {
+	case timeType:
+		return decodeTimestamp(val, v, s)
+	case durationType:
+		return decodeDuration(val, v, s)
+	}
 
 	kind := val.Kind()
 	switch kind {
-	case reflect.Interface:
-		return decodeStruct(val.Elem(), v, unsafe)
 	case reflect.Struct:
-		return decodeStruct(val, v, unsafe)
+		return decodeStruct(val, v, s)
 	case reflect.Slice:
-		switch val.Type().Elem().Kind() {
-		case reflect.Slice, reflect.Struct, reflect.Ptr:
+		switch t := val.Type().Elem(); {
+		case t == durationType, t.Kind() == reflect.Slice, t.Kind() == reflect.Array,
+			t.Kind() == reflect.Struct, t.Kind() == reflect.Ptr:
 			elem := reflect.New(val.Type().Elem()).Elem()
-			if err = decodeBytes(elem, v, unsafe); err != nil {
+			if err = decodeBytes(elem, v, s); err != nil {
 				return err
 			}
 			val.Set(reflect.Append(val, elem))
@@ -180,31 +595,92 @@ func decodeBytes(val reflect.Value, v []byte, unsafe bool) error {
 		}
 	case reflect.Ptr:
 		if val.IsNil() {
+			if err = s.alloc(int(val.Type().Elem().Size())); err != nil {
+				return err
+			}
 			val.Set(reflect.New(val.Type().Elem()))
 		}
-		return decodeBytes(val.Elem(), v, unsafe)
+		return decodeBytes(val.Elem(), v, s)
+	case reflect.Map:
+		return decodeMap(val, v, s)
 	}
 
 	switch kind {
 	case reflect.String:
+		if err = s.checkUTF8(v); err != nil {
+			return err
+		}
+		if err = s.alloc(len(v)); err != nil {
+			return err
+		}
 		val.SetString(string(v))
 	case reflect.Slice:
 		switch val.Type().Elem().Kind() {
 		case reflect.String:
+			if err = s.checkUTF8(v); err != nil {
+				return err
+			}
+			if err = s.alloc(len(v)); err != nil {
+				return err
+			}
 			elem := reflect.New(val.Type().Elem()).Elem()
 			elem.SetString(string(v))
 			val.Set(reflect.Append(val, elem))
 		case reflect.Uint8: // []byte
-			if !unsafe {
-				val.SetBytes(append([]byte(nil), v...))
-			} else {
+			if s.unsafe {
 				val.SetBytes(v)
+			} else if err = s.alloc(len(v)); err == nil {
+				val.SetBytes(append([]byte(nil), v...))
 			}
 		}
+	case reflect.Array:
+		if val.Type().Elem().Kind() != reflect.Uint8 {
+			break
+		}
+		if len(v) != val.Len() {
+			return fmt.Errorf("bytes length %d does not match array length %d", len(v), val.Len())
+		}
+		for i, b := range v {
+			val.Index(i).SetUint(uint64(b))
+		}
 	}
 	return err
 }
 
+// decodeMap decodes the map entry message data and stores the entry in
+// the map val, which is allocated if nil. A missing key or value decodes
+// as the zero value, a missing message value as an empty message.
+func decodeMap(val reflect.Value, data []byte, s *decodeState) error {
+	entry := reflect.New(mapEntryType(val.Type())).Elem()
+	if err := decodeStruct(entry, data, s); err != nil {
+		return err
+	}
+
+	k, v := entry.Field(0), entry.Field(1)
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		v.Set(reflect.New(v.Type().Elem()))
+	}
+	if val.IsNil() {
+		val.Set(reflect.MakeMap(val.Type()))
+	}
+	val.SetMapIndex(k, v)
+	return nil
+}
+
+// decodeWrapped decodes the wrapper message data and stores its value in
+// the pointer val, which is allocated if nil.
+func decodeWrapped(val reflect.Value, data []byte, s *decodeState) error {
+	w := reflect.New(valueWrapperType(val.Type().Elem())).Elem()
+	if err := decodeStruct(w, data, s); err != nil {
+		return err
+	}
+	if val.IsNil() {
+		val.Set(reflect.New(val.Type().Elem()))
+	}
+	val.Elem().Set(w.Field(0))
+	return nil
+}
+
 func decodeUvarint(val reflect.Value, v uint64) error {
 	if _, ok := val.Interface().(time.Time); ok {
 		ns := int64(v)
@@ -214,9 +690,9 @@ func decodeUvarint(val reflect.Value, v uint64) error {
 	}
 
 	switch val.Kind() {
-	case reflect.Int32, reflect.Int64:
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		return setInt(val, int64(v))
-	case reflect.Uint32, reflect.Uint64:
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 		return setUint(val, v)
 	case reflect.Bool:
 		return setBool(val, v)
@@ -237,10 +713,10 @@ func decodeUvarint(val reflect.Value, v uint64) error {
 
 func decodeFixed64(val reflect.Value, v uint64) error {
 	switch val.Kind() {
-	//case reflect.Int64:
-	//  return setInt(val, int64(v))
-	//case reflect.Uint64:
-	//  return setUint(val, v)
+	case reflect.Int, reflect.Int64:
+		return setInt(val, int64(v))
+	case reflect.Uint, reflect.Uint64:
+		return setUint(val, v)
 	case reflect.Float64:
 		return setFloat(val, math.Float64frombits(v))
 	case reflect.Ptr:
@@ -260,10 +736,10 @@ func decodeFixed64(val reflect.Value, v uint64) error {
 
 func decodeFixed32(val reflect.Value, v uint32) error {
 	switch val.Kind() {
-	//case reflect.Int32:
-	//  return setInt(val, int64(int32(v)))
-	//case reflect.Uint32:
-	//  return setUint(val, uint64(v))
+	case reflect.Int8, reflect.Int16, reflect.Int32:
+		return setInt(val, int64(int32(v)))
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return setUint(val, uint64(v))
 	case reflect.Float32:
 		return setFloat(val, float64(math.Float32frombits(v)))
 	case reflect.Ptr:
@@ -283,7 +759,7 @@ func decodeFixed32(val reflect.Value, v uint32) error {
 
 func setUint(val reflect.Value, v uint64) error {
 	if val.OverflowUint(v) {
-		return errors.New("uint overflow")
+		return fmt.Errorf("%w: %d does not fit %s", ErrOverflow, v, val.Type())
 	}
 	val.SetUint(v)
 	return nil
@@ -291,7 +767,7 @@ func setUint(val reflect.Value, v uint64) error {
 
 func setInt(val reflect.Value, v int64) error {
 	if val.OverflowInt(v) {
-		return errors.New("int overflow")
+		return fmt.Errorf("%w: %d does not fit %s", ErrOverflow, v, val.Type())
 	}
 	val.SetInt(v)
 	return nil
@@ -311,7 +787,7 @@ func setBool(val reflect.Value, v uint64) error {
 
 func setFloat(val reflect.Value, v float64) error {
 	if val.OverflowFloat(v) {
-		return errors.New("float64 overflow")
+		return fmt.Errorf("%w: %g does not fit %s", ErrOverflow, v, val.Type())
 	}
 	val.SetFloat(v)
 	return nil
@@ -2,6 +2,7 @@ package protobuf
 
 import (
 	"crypto/rand"
+	"encoding/hex"
 	"io"
 	"math"
 	"reflect"
@@ -20,7 +21,7 @@ func init() {
 	if _, err := io.ReadFull(rand.Reader, testBytes[:]); err != nil {
 		panic("not enough entropy")
 	}
-	testString = string(testBytes[:])
+	testString = hex.EncodeToString(testBytes[:])
 }
 
 var (
@@ -100,7 +101,7 @@ func TestTypeDecode(t *testing.T) {
 
 		m := &testproto.TypesMessage{}
 		val := reflect.ValueOf(m)
-		if err = decodeStruct(val.Elem(), data, true); err != nil {
+		if err = decodeStruct(val.Elem(), data, &decodeState{unsafe: true}); err != nil {
 			t.Fatalf("decode type: %v", err)
 		}
 
@@ -121,7 +122,7 @@ func TestSliceDecode(t *testing.T) {
 
 		m := &testproto.SliceMessage{}
 		val := reflect.ValueOf(m)
-		if err = decodeStruct(val.Elem(), data, true); err != nil {
+		if err = decodeStruct(val.Elem(), data, &decodeState{unsafe: true}); err != nil {
 			t.Fatalf("decode slice: %v", err)
 		}
 
@@ -142,7 +143,7 @@ func TestStrucDecode(t *testing.T) {
 
 		m := &testproto.StructMessage{}
 		val := reflect.ValueOf(m)
-		if err = decodeStruct(val.Elem(), data, true); err != nil {
+		if err = decodeStruct(val.Elem(), data, &decodeState{unsafe: true}); err != nil {
 			t.Fatalf("decode struct: %v", err)
 		}
 
@@ -151,3 +152,285 @@ func TestStrucDecode(t *testing.T) {
 		}
 	}
 }
+
+type testOlder struct {
+	ID   uint64 `protobuf:"1"`
+	Name string `protobuf:"5"`
+	Tail int32  `protobuf:"9"`
+}
+
+type testNewer struct {
+	ID      uint64    `protobuf:"1"`
+	Varint  int64     `protobuf:"2"`
+	Fixed32 float32   `protobuf:"3"`
+	Fixed64 float64   `protobuf:"4"`
+	Name    string    `protobuf:"5"`
+	Bytes   []byte    `protobuf:"6"`
+	Nested  testOlder `protobuf:"7"`
+	Strings []string  `protobuf:"8"`
+	Tail    int32     `protobuf:"9"`
+}
+
+func TestSkipUnknownFields(t *testing.T) {
+	t.Parallel()
+
+	v := &testNewer{
+		ID:      1,
+		Varint:  -2,
+		Fixed32: 3,
+		Fixed64: 4,
+		Name:    "five",
+		Bytes:   []byte("six"),
+		Nested:  testOlder{ID: 7, Name: "seven"},
+		Strings: []string{"eight", "eight"},
+		Tail:    9,
+	}
+	data, err := Marshal(nil, v)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	// group 10 containing a varint, a nested group and a string
+	data = append(data, 10<<3|wireStartGroup, 1<<3|wireVarint, 1,
+		2<<3|wireStartGroup, 2<<3|wireEndGroup,
+		3<<3|wireBytes, 1, 'x', 10<<3|wireEndGroup)
+	// trailing fixed32 and fixed64 values
+	data = append(data, 11<<3|wireFixed32, 1, 2, 3, 4)
+	data = append(data, 12<<3|wireFixed64, 1, 2, 3, 4, 5, 6, 7, 8)
+
+	m := &testOlder{}
+	if err = Unmarshal(data, m); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	expected := &testOlder{ID: 1, Name: "five", Tail: 9}
+	if !reflect.DeepEqual(expected, m) {
+		t.Fatalf("skip unknown fields: expected %#v, got %#v", expected, m)
+	}
+
+	for _, bad := range [][]byte{
+		{10<<3 | wireStartGroup, 1<<3 | wireVarint, 1},
+		{10<<3 | wireStartGroup, 11<<3 | wireEndGroup},
+		{10<<3 | wireEndGroup},
+		{10<<3 | wireBytes, 2, 'x'},
+		{10<<3 | wireFixed64, 1, 2, 3},
+		{10<<3 | 7},
+	} {
+		if err = Unmarshal(bad, &testOlder{}); err == nil {
+			t.Fatalf("skip unknown fields %q: expected error", bad)
+		}
+	}
+}
+
+type testOlderUnknown struct {
+	ID      uint64 `protobuf:"1"`
+	Name    string `protobuf:"5"`
+	Tail    int32  `protobuf:"9"`
+	Unknown UnknownFields
+}
+
+type testOlderUnrecognized struct {
+	ID               uint64
+	XXX_unrecognized []byte
+}
+
+func TestPreserveUnknownFields(t *testing.T) {
+	t.Parallel()
+
+	v := &testNewer{
+		ID:      1,
+		Varint:  -2,
+		Fixed32: 3,
+		Fixed64: 4,
+		Name:    "five",
+		Bytes:   []byte("six"),
+		Nested:  testOlder{ID: 7, Name: "seven"},
+		Strings: []string{"eight", "eight"},
+		Tail:    9,
+	}
+	data, err := Marshal(nil, v)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	for _, older := range []interface{}{&testOlderUnknown{}, &testOlderUnrecognized{}} {
+		if err = Unmarshal(data, older); err != nil {
+			t.Fatalf("unmarshal %T: %v", older, err)
+		}
+
+		xdata, err := Marshal(nil, older)
+		if err != nil {
+			t.Fatalf("marshal %T: %v", older, err)
+		}
+		if n := sizeStruct(reflect.ValueOf(older).Elem()); n != len(xdata) {
+			t.Fatalf("unknown fields %T: expected size %d, got %d", older, len(xdata), n)
+		}
+
+		m := &testNewer{}
+		if err = Unmarshal(xdata, m); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		if !reflect.DeepEqual(v, m) {
+			t.Fatalf("unknown fields %T: expected %#v, got %#v", older, v, m)
+		}
+	}
+}
+
+type testPacked struct {
+	Int32s  []int32   `protobuf:"1"`
+	Sint64s []int64   `protobuf:"2,zigzag"`
+	Fixed32 []uint32  `protobuf:"3,fixed"`
+	Floats  []float64 `protobuf:"4"`
+	Bools   []bool    `protobuf:"5"`
+}
+
+type testUnpacked struct {
+	Int32s  []int32   `protobuf:"1,unpacked"`
+	Sint64s []int64   `protobuf:"2,zigzag,unpacked"`
+	Fixed32 []uint32  `protobuf:"3,fixed,unpacked"`
+	Floats  []float64 `protobuf:"4,unpacked"`
+	Bools   []bool    `protobuf:"5,unpacked"`
+}
+
+func TestPackedDecode(t *testing.T) {
+	t.Parallel()
+
+	packed := &testPacked{
+		Int32s:  []int32{1, -1, math.MaxInt32},
+		Sint64s: []int64{-2, 2, math.MinInt64},
+		Fixed32: []uint32{3, math.MaxUint32},
+		Floats:  []float64{4.5, -4.5},
+		Bools:   []bool{true, false, true},
+	}
+	unpacked := &testUnpacked{
+		Int32s:  packed.Int32s,
+		Sint64s: packed.Sint64s,
+		Fixed32: packed.Fixed32,
+		Floats:  packed.Floats,
+		Bools:   packed.Bools,
+	}
+
+	pdata, err := Marshal(nil, packed)
+	if err != nil {
+		t.Fatalf("marshal packed: %v", err)
+	}
+	udata, err := Marshal(nil, unpacked)
+	if err != nil {
+		t.Fatalf("marshal unpacked: %v", err)
+	}
+	if len(pdata) >= len(udata) {
+		t.Fatalf("packed: expected packed size %d < unpacked size %d", len(pdata), len(udata))
+	}
+	if n := sizeStruct(reflect.ValueOf(packed).Elem()); n != len(pdata) {
+		t.Fatalf("packed: expected size %d, got %d", len(pdata), n)
+	}
+	if n := sizeStruct(reflect.ValueOf(unpacked).Elem()); n != len(udata) {
+		t.Fatalf("unpacked: expected size %d, got %d", len(udata), n)
+	}
+
+	for _, data := range [][]byte{pdata, udata} {
+		pm, um := &testPacked{}, &testUnpacked{}
+		if err = Unmarshal(data, pm); err != nil {
+			t.Fatalf("unmarshal packed: %v", err)
+		}
+		if err = Unmarshal(data, um); err != nil {
+			t.Fatalf("unmarshal unpacked: %v", err)
+		}
+		if !reflect.DeepEqual(packed, pm) {
+			t.Fatalf("packed decode: expected %#v, got %#v", packed, pm)
+		}
+		if !reflect.DeepEqual(unpacked, um) {
+			t.Fatalf("unpacked decode: expected %#v, got %#v", unpacked, um)
+		}
+	}
+
+	// both forms of the same field are concatenated
+	m := &testPacked{}
+	if err = Unmarshal(append(append([]byte(nil), pdata...), udata...), m); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if expected := append(packed.Int32s, packed.Int32s...); !reflect.DeepEqual(expected, m.Int32s) {
+		t.Fatalf("mixed decode: expected %v, got %v", expected, m.Int32s)
+	}
+}
+
+type intKinds struct {
+	Int    int      `protobuf:"1"`
+	Int8   int8     `protobuf:"2,zigzag"`
+	Int16  int16    `protobuf:"3,fixed"`
+	Uint   uint     `protobuf:"4"`
+	Uint8  uint8    `protobuf:"5"`
+	Uint16 uint16   `protobuf:"6"`
+	Ints   []int    `protobuf:"7"`
+	Int8s  []int8   `protobuf:"8"`
+	Uints  []uint16 `protobuf:"9,unpacked"`
+}
+
+type intKindsWide struct {
+	Int    int64  `protobuf:"1"`
+	Int8   int32  `protobuf:"2,zigzag"`
+	Int16  int32  `protobuf:"3,fixed"`
+	Uint   uint64 `protobuf:"4"`
+	Uint8  uint32 `protobuf:"5"`
+	Uint16 uint32 `protobuf:"6"`
+}
+
+func TestIntKinds(t *testing.T) {
+	t.Parallel()
+
+	v := &intKinds{
+		Int:    math.MinInt64,
+		Int8:   math.MinInt8,
+		Int16:  math.MinInt16,
+		Uint:   math.MaxUint64,
+		Uint8:  math.MaxUint8,
+		Uint16: math.MaxUint16,
+		Ints:   []int{-1, 0, math.MaxInt64},
+		Int8s:  []int8{-1, math.MaxInt8},
+		Uints:  []uint16{1, math.MaxUint16},
+	}
+	data, err := Marshal(nil, v)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if n := sizeStruct(reflect.ValueOf(v).Elem()); n != len(data) {
+		t.Fatalf("int kinds: expected size %d, got %d", len(data), n)
+	}
+
+	m := &intKinds{}
+	if err = Unmarshal(data, m); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(v, m) {
+		t.Fatalf("int kinds: expected %#v, got %#v", v, m)
+	}
+
+	w := &intKindsWide{}
+	if err = Unmarshal(data, w); err != nil {
+		t.Fatalf("unmarshal wide: %v", err)
+	}
+	expected := &intKindsWide{
+		Int:    math.MinInt64,
+		Int8:   math.MinInt8,
+		Int16:  math.MinInt16,
+		Uint:   math.MaxUint64,
+		Uint8:  math.MaxUint8,
+		Uint16: math.MaxUint16,
+	}
+	if !reflect.DeepEqual(expected, w) {
+		t.Fatalf("int kinds: expected %#v, got %#v", expected, w)
+	}
+
+	for _, w := range []*intKindsWide{
+		{Int8: math.MaxInt8 + 1},
+		{Int16: math.MinInt16 - 1},
+		{Uint8: math.MaxUint8 + 1},
+		{Uint16: math.MaxUint16 + 1},
+	} {
+		if data, err = Marshal(nil, w); err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+		if err = Unmarshal(data, &intKinds{}); err == nil {
+			t.Fatalf("unmarshal %#v: expected overflow error", w)
+		}
+	}
+}
@@ -2,17 +2,22 @@ package protobuf
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"math"
 	"reflect"
+	"sort"
 	"time"
+	"unicode/utf8"
 )
 
 const (
-	wireVarint  = 0
-	wireFixed64 = 1
-	wireBytes   = 2
-	wireFixed32 = 5
+	wireVarint     = 0
+	wireFixed64    = 1
+	wireBytes      = 2
+	wireStartGroup = 3
+	wireEndGroup   = 4
+	wireFixed32    = 5
 )
 
 // Writer defines the encode writer. Typically this is a *bufio.Writer.
@@ -25,8 +30,10 @@ type Writer interface {
 // Encoder manages the transmission of type and data information to the
 // other side of a connection.
 type Encoder struct {
-	w   Writer
-	max int
+	w    Writer
+	max  int
+	opts MarshalOptions
+	buf  buffer // scratch buffer of Encode
 }
 
 // NewEncoder returns a new encoder that will transmit on the io.Writer.
@@ -37,6 +44,11 @@ func NewEncoder(w Writer, max int) *Encoder {
 	return &Encoder{w: w, max: max}
 }
 
+// SetOptions sets the options used by subsequent calls to Encode.
+func (e *Encoder) SetOptions(opts MarshalOptions) {
+	e.opts = opts
+}
+
 // Encode transmits the data item represented by the empty interface value,
 // guaranteeing that all necessary type information has been transmitted
 // first.
@@ -45,95 +57,227 @@ func NewEncoder(w Writer, max int) *Encoder {
 // v recursively and writes the Protocol Buffer encoding of v. The struct
 // underlying v must be a pointer.
 //
-// Encode currently encodes all visible field and ignores unsupported
-// Protocol Buffer struct field types.
+// Encode currently encodes all visible field. Fields of kinds without a
+// Protocol Buffer type, such as channels and functions, are ignored, but
+// unsupported map, interface and Marshaler field types fail the encoding.
 func (e *Encoder) Encode(v interface{}) error {
 	val := reflect.ValueOf(v)
 	if val.Kind() != reflect.Ptr || val.Elem().Kind() != reflect.Struct {
 		return errors.New("v must be a pointer to a struct")
 	}
 
-	val = val.Elem()
-	fields := val.NumField()
-	size := sizeStruct(val, fields)
+	// encode into the scratch buffer first, so that a failed encoding
+	// does not leave a partial message in the stream
+	w := e.w
+	e.buf, e.w = e.buf[:0], &e.buf
+	err := e.encodeStruct(val.Elem())
+	e.w = w
+	if err != nil {
+		return err
+	}
 
-	if err := writeLength(e.w, size, e.max); err != nil {
+	if err = writeLength(e.w, len(e.buf), e.max); err != nil {
 		return err
 	}
-	return e.encodeStruct(val, fields)
+	_, err = e.w.Write(e.buf)
+	return err
 }
 
-func (e *Encoder) encodeStruct(val reflect.Value, fields int) error {
+func (e *Encoder) encodeStruct(val reflect.Value) error {
+	info := getStructInfo(val.Type())
+	if info.marshaler {
+		return e.writeMarshaler(val)
+	}
+	if info.err != nil {
+		return info.err
+	}
+
 	var field reflect.Value
 	var custom bool
 	var err error
-	for i := 0; i < fields && err == nil; i++ {
-		field = val.Field(i)
-		if !field.CanSet() {
+	for i := 0; i < len(info.fields) && err == nil; i++ {
+		f := &info.fields[i]
+		key := f.num
+		field = val.Field(f.index)
+
+		if custom, err = e.encodeCustom(field, f); err != nil || custom {
 			continue
 		}
-
-		if custom, err = e.encodeCustom(field, i+1); err != nil || custom {
+		if f.wrapped {
+			err = e.encodeWrapped(field, f)
 			continue
 		}
 
 		switch field.Kind() {
 		case reflect.Interface:
-			panic("interface encoding not implemented")
+			err = e.encodeOneof(field, f)
 		case reflect.Struct:
-			err = e.writeStruct(i+1, field)
+			err = e.writeStruct(key, field)
 		case reflect.Ptr:
 			v := field.Elem()
 			switch v.Kind() {
 			case reflect.Struct:
-				err = e.writeStruct(i+1, v)
+				err = e.writeStruct(key, v)
 			case reflect.Ptr:
 				// nothing
 			case reflect.Slice:
 				// nothing
 			default:
-				err = e.encodeBasic(v, i+1)
+				// a non-nil pointer marks the field as present
+				err = e.writeValue(v, f)
 			}
 		case reflect.Slice:
-			err = e.encodeSlice(field, i+1)
+			err = e.encodeSlice(field, f)
+		case reflect.Array:
+			err = e.encodeArray(field, f)
+		case reflect.Map:
+			err = e.encodeMap(field, f)
 		default:
-			err = e.encodeBasic(field, i+1)
+			err = e.encodeBasic(field, f)
 		}
 	}
+	if err == nil && info.unknown >= 0 {
+		_, err = e.w.Write(val.Field(info.unknown).Bytes())
+	}
 	return err
 }
 
-func (e *Encoder) encodeCustom(val reflect.Value, key int) (bool, error) {
+// encodeCustom writes values that are not encoded by their kind and
+// reports whether val is one of them:
+//
+//   - registered types with their codec
+//   - errors as strings
+//   - time.Time as Timestamp, or as varint with the unixnano option
+//   - time.Duration as Duration
+//   - value trees as Struct, ListValue and Value
+//
+// Zero values are skipped, unless held by a non-nil pointer.
+func (e *Encoder) encodeCustom(val reflect.Value, f *fieldInfo) (bool, error) {
+	if c := lookupCodec(val.Type()); c != nil {
+		if isZeroValue(val) {
+			return true, nil
+		}
+		return true, e.writeCodec(f.num, c, val)
+	}
+	if val.Kind() == reflect.Ptr {
+		if c := lookupCodec(val.Type().Elem()); c != nil {
+			if val.IsNil() {
+				return true, nil
+			}
+			return true, e.writeCodec(f.num, c, val.Elem())
+		}
+	}
+	if isValueTree(val.Type()) {
+		msg, err := valueTreeMessage(val)
+		if err != nil || msg == nil {
+			return true, err
+		}
+		return true, e.writeStruct(f.num, reflect.ValueOf(msg).Elem())
+	}
+
 	itype := val.Interface()
 	if t, ok := itype.(error); ok || val.Type() == errorType {
 		if val.IsNil() {
 			return true, nil
 		}
-		return true, e.writeString(key, t.Error())
+		return true, e.writeString(f.num, t.Error())
 	}
 	if t, ok := itype.(time.Time); ok {
 		if t.IsZero() {
 			return true, nil
 		}
-		return true, e.writeUvarint(key, uint64(t.UnixNano()))
+		return true, e.writeTime(f, t)
+	}
+	if t, ok := itype.(*time.Time); ok {
+		if t == nil {
+			return true, nil
+		}
+		return true, e.writeTime(f, *t)
+	}
+	if d, ok := itype.(time.Duration); ok {
+		if d == 0 {
+			return true, nil
+		}
+		return true, e.writeDuration(f.num, d)
+	}
+	if d, ok := itype.(*time.Duration); ok {
+		if d == nil {
+			return true, nil
+		}
+		return true, e.writeDuration(f.num, *d)
 	}
 	return false, nil
 }
 
-func (e *Encoder) encodeSlice(val reflect.Value, key int) (err error) {
+// writeDuration writes d as a google.protobuf.Duration, even if d is 0.
+func (e *Encoder) writeDuration(key int, d time.Duration) error {
+	return e.writeStruct(key, reflect.ValueOf(newDuration(d)))
+}
+
+// writeTime writes t as a google.protobuf.Timestamp or, if f is a
+// unixnano field, as varint, even if t is the zero time.
+func (e *Encoder) writeTime(f *fieldInfo, t time.Time) error {
+	if f.unixnano {
+		return e.writeUvarint(f.num, uint64(t.UnixNano()))
+	}
+	ts, err := newTimestamp(t)
+	if err != nil {
+		return err
+	}
+	return e.writeStruct(f.num, reflect.ValueOf(ts))
+}
+
+func (e *Encoder) encodeSlice(val reflect.Value, f *fieldInfo) (err error) {
 	vlen := val.Len()
 	if vlen == 0 {
 		return nil
 	}
 
-	switch val.Type().Elem().Kind() {
-	case reflect.Int32, reflect.Int64:
+	key, kind := f.num, val.Type().Elem().Kind()
+	if c := lookupCodec(val.Type().Elem()); c != nil {
+		for i := 0; i < vlen && err == nil; i++ {
+			err = e.writeCodec(key, c, val.Index(i))
+		}
+		return err
+	}
+	if t := val.Type().Elem(); t == timeType || t == timePtrType {
+		for i := 0; i < vlen && err == nil; i++ {
+			v := val.Index(i)
+			if t == timePtrType {
+				if v.IsNil() {
+					return errors.New("repeated message has nil element")
+				}
+				v = v.Elem()
+			}
+			err = e.writeTime(f, v.Interface().(time.Time))
+		}
+		return err
+	}
+	if t := val.Type().Elem(); t == durationType || t == durationPtrType {
+		for i := 0; i < vlen && err == nil; i++ {
+			v := val.Index(i)
+			if t == durationPtrType {
+				if v.IsNil() {
+					return errors.New("repeated message has nil element")
+				}
+				v = v.Elem()
+			}
+			err = e.writeDuration(key, time.Duration(v.Int()))
+		}
+		return err
+	}
+	if !f.unpacked && packable(kind) {
+		return e.writePacked(val, f)
+	}
+
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		for i := 0; i < vlen && err == nil; i++ {
-			err = e.writeUvarint(key, uint64(val.Index(i).Int()))
+			err = e.writeInt(f, kind, f.intValue(val.Index(i).Int()))
 		}
-	case reflect.Uint32, reflect.Uint64:
+	case reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 		for i := 0; i < vlen && err == nil; i++ {
-			err = e.writeUvarint(key, val.Index(i).Uint())
+			err = e.writeInt(f, kind, val.Index(i).Uint())
 		}
 	case reflect.Float32:
 		for i := 0; i < vlen && err == nil; i++ {
@@ -157,67 +301,330 @@ func (e *Encoder) encodeSlice(val reflect.Value, key int) (err error) {
 		err = e.writeBytes(key, val.Bytes())
 	case reflect.Slice:
 		for i := 0; i < vlen && err == nil; i++ {
-			err = e.encodeSlice(val.Index(i), key)
+			err = e.encodeSlice(val.Index(i), f)
+		}
+	case reflect.Array:
+		for i := 0; i < vlen && err == nil; i++ {
+			err = e.writeValue(val.Index(i), f)
 		}
 	case reflect.Struct:
-		panic("struct slice not implemented")
+		for i := 0; i < vlen && err == nil; i++ {
+			err = e.writeStruct(key, val.Index(i))
+		}
 	case reflect.Ptr:
-		panic("pointer slice not implemented")
+		if val.Type().Elem().Elem().Kind() != reflect.Struct {
+			return nil
+		}
+		for i := 0; i < vlen && err == nil; i++ {
+			v := val.Index(i)
+			if v.IsNil() {
+				return errors.New("repeated message has nil element")
+			}
+			err = e.writeStruct(key, v.Elem())
+		}
 	}
 	return err
 }
 
-func (e *Encoder) encodeBasic(val reflect.Value, key int) error {
-	switch val.Kind() {
-	case reflect.Int32, reflect.Int64:
-		v := uint64(val.Int())
-		if v == 0 {
-			return nil
+// encodeArray writes a byte array as bytes and any other array as a
+// repeated field. Arrays whose scalar elements are all zero are omitted.
+func (e *Encoder) encodeArray(val reflect.Value, f *fieldInfo) error {
+	switch val.Type().Elem().Kind() {
+	case reflect.Uint8:
+		return e.encodeBasic(val, f)
+	case reflect.Struct, reflect.Ptr:
+		return e.encodeSlice(val, f)
+	}
+	if isZero(val) {
+		return nil
+	}
+	return e.encodeSlice(val, f)
+}
+
+// encodeWrapped writes the non-nil pointer val as a wrapper message, whose
+// value field is omitted if it is zero.
+func (e *Encoder) encodeWrapped(val reflect.Value, f *fieldInfo) error {
+	if val.IsNil() {
+		return nil
+	}
+	return e.writeStruct(f.num, wrapValue(val.Elem()))
+}
+
+// isNilMessage reports whether val is a nil pointer to a type that is
+// encoded as a message.
+func isNilMessage(val reflect.Value) bool {
+	if val.Kind() != reflect.Ptr || !val.IsNil() || fieldCodec(val.Type()) != nil {
+		return false
+	}
+	t := val.Type().Elem()
+	return t.Kind() == reflect.Struct || t == durationType
+}
+
+// encodeOneof writes the value of the oneof wrapper held by the interface
+// val with the field number of its case, even if the value is zero. A nil
+// message is written as empty message, any other nil pointer as the zero
+// value of its element type. A nil value of a registered type fails.
+func (e *Encoder) encodeOneof(val reflect.Value, f *fieldInfo) error {
+	if val.IsNil() {
+		return nil
+	}
+	c := f.oneofCase(val.Elem().Type())
+	if c == nil {
+		return fmt.Errorf("%s: unregistered oneof wrapper %s", f.name, val.Elem().Type())
+	}
+	if val.Elem().IsNil() {
+		return fmt.Errorf("%s: oneof wrapper %s is nil", f.name, val.Elem().Type())
+	}
+
+	v := val.Elem().Elem().Field(c.inner)
+	if isNilMessage(v) {
+		return e.writeBytes(c.num, nil)
+	}
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		if lookupCodec(v.Type()) != nil {
+			return fmt.Errorf("%s: oneof case %s is nil", f.name, v.Type())
 		}
-		return e.writeUvarint(key, v)
-	case reflect.Uint32, reflect.Uint64:
-		v := val.Uint()
-		if v == 0 {
-			return nil
+		v = reflect.Zero(v.Type().Elem())
+	}
+	switch {
+	case lookupCodec(v.Type()) != nil:
+		return e.writeCodec(c.num, lookupCodec(v.Type()), v)
+	case v.Type() == timeType:
+		return e.writeTime(c, v.Interface().(time.Time))
+	case v.Type() == durationType:
+		return e.writeDuration(c.num, time.Duration(v.Int()))
+	}
+	if custom, err := e.encodeCustom(v, c); err != nil || custom {
+		return err
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		return e.writeStruct(c.num, v)
+	case reflect.Ptr:
+		if v.Elem().Kind() == reflect.Struct {
+			return e.writeStruct(c.num, v.Elem())
 		}
-		return e.writeUvarint(key, v)
-	case reflect.Float32:
-		v := math.Float32bits(float32(val.Float()))
-		if v == 0 {
-			return nil
+		return e.writeValue(v.Elem(), c)
+	}
+	return e.writeValue(v, c)
+}
+
+// encodeMap writes every entry of the map val as a map entry message with
+// the key in field 1 and the value in field 2.
+func (e *Encoder) encodeMap(val reflect.Value, f *fieldInfo) (err error) {
+	if val.Len() == 0 {
+		return nil
+	}
+
+	keys := val.MapKeys()
+	if e.opts.Deterministic {
+		sortMapKeys(keys)
+	}
+	for i := 0; i < len(keys) && err == nil; i++ {
+		k, v := keys[i], val.MapIndex(keys[i])
+		if err = e.writeKey(f.num, wireBytes); err != nil {
+			return err
 		}
-		return e.writeFixed32(key, v)
-	case reflect.Float64:
-		v := math.Float64bits(val.Float())
-		if v == 0 {
-			return nil
+		n := sizeMapEntry(k, v)
+		if err = writeUvarint(e.w, uint64(n)); err != nil {
+			return err
 		}
-		return e.writeFixed64(key, v)
-	case reflect.Bool:
-		v := val.Bool()
-		if !v {
-			return nil
+		start := e.written()
+		if err = e.writeValue(k, &mapKeyField); err != nil {
+			return err
+		}
+		if err = e.writeMapValue(v); err != nil {
+			return err
+		}
+		err = e.checkSize(val.Type(), start, n)
+	}
+	return err
+}
+
+func (e *Encoder) writeMapValue(v reflect.Value) error {
+	if c := lookupCodec(v.Type()); c != nil {
+		return e.writeCodec(mapValueField.num, c, v)
+	}
+	if v.Type() == timeType {
+		return e.writeTime(&mapValueField, v.Interface().(time.Time))
+	}
+	if v.Type() == timePtrType && !v.IsNil() {
+		return e.writeTime(&mapValueField, v.Elem().Interface().(time.Time))
+	}
+	if v.Type() == durationType {
+		return e.writeDuration(mapValueField.num, time.Duration(v.Int()))
+	}
+	if v.Type() == durationPtrType && !v.IsNil() {
+		return e.writeDuration(mapValueField.num, time.Duration(v.Elem().Int()))
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		return e.writeStruct(mapValueField.num, v)
+	case reflect.Ptr:
+		if v.IsNil() {
+			return e.writeBytes(mapValueField.num, nil)
+		}
+		return e.writeStruct(mapValueField.num, v.Elem())
+	}
+	return e.writeValue(v, &mapValueField)
+}
+
+// sortMapKeys sorts map keys in ascending order.
+func sortMapKeys(keys []reflect.Value) {
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		switch a.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return a.Int() < b.Int()
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return a.Uint() < b.Uint()
+		case reflect.Bool:
+			return !a.Bool() && b.Bool()
 		}
-		return e.writeBool(key, v)
+		return a.String() < b.String()
+	})
+}
+
+func (e *Encoder) encodeBasic(val reflect.Value, f *fieldInfo) error {
+	if isZero(val) {
+		return nil
+	}
+	return e.writeValue(val, f)
+}
+
+// writeValue writes the scalar, string or bytes value val with the key of
+// f, even if it is the zero value.
+func (e *Encoder) writeValue(val reflect.Value, f *fieldInfo) error {
+	key, kind := f.num, val.Kind()
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return e.writeInt(f, kind, f.intValue(val.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return e.writeInt(f, kind, val.Uint())
+	case reflect.Float32:
+		return e.writeFixed32(key, math.Float32bits(float32(val.Float())))
+	case reflect.Float64:
+		return e.writeFixed64(key, math.Float64bits(val.Float()))
+	case reflect.Bool:
+		return e.writeBool(key, val.Bool())
 	case reflect.String:
-		v := val.String()
-		if v == "" {
-			return nil
+		return e.writeString(key, val.String())
+	case reflect.Slice:
+		if val.Type().Elem().Kind() == reflect.Uint8 {
+			return e.writeBytes(key, val.Bytes())
+		}
+	case reflect.Array:
+		if val.Type().Elem().Kind() == reflect.Uint8 {
+			return e.writeBytes(key, arrayBytes(val))
 		}
-		return e.writeString(key, v)
 	}
 	return nil
 }
 
+// arrayBytes returns a copy of the elements of the byte array val.
+func arrayBytes(val reflect.Value) []byte {
+	b := make([]byte, val.Len())
+	for i := range b {
+		b[i] = byte(val.Index(i).Uint())
+	}
+	return b
+}
+
+// isZero reports whether the scalar, string or bytes value val is empty
+// and therefore omitted from the encoding.
+func isZero(val reflect.Value) bool {
+	switch val.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return val.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return val.Uint() == 0
+	case reflect.Float32:
+		return math.Float32bits(float32(val.Float())) == 0
+	case reflect.Float64:
+		return math.Float64bits(val.Float()) == 0
+	case reflect.Bool:
+		return !val.Bool()
+	case reflect.String, reflect.Slice:
+		return val.Len() == 0
+	case reflect.Array:
+		for i := 0; i < val.Len(); i++ {
+			if !isZero(val.Index(i)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// writeInt writes the integer v of the given kind as varint or, if f is
+// a fixed field, with the width of its kind.
+func (e *Encoder) writeInt(f *fieldInfo, kind reflect.Kind, v uint64) error {
+	if !f.fixed {
+		return e.writeUvarint(f.num, v)
+	}
+	if fixedSize(kind) == 4 {
+		return e.writeFixed32(f.num, uint32(v))
+	}
+	return e.writeFixed64(f.num, v)
+}
+
+// writePacked writes the scalar slice val as a single length-delimited
+// field, with the elements encoded back to back without keys.
+func (e *Encoder) writePacked(val reflect.Value, f *fieldInfo) (err error) {
+	if err = e.writeKey(f.num, wireBytes); err != nil {
+		return err
+	}
+	if err = writeUvarint(e.w, uint64(sizePacked(val, f))); err != nil {
+		return err
+	}
+
+	kind := val.Type().Elem().Kind()
+	for i := 0; i < val.Len() && err == nil; i++ {
+		v := val.Index(i)
+		switch kind {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			err = e.writeIntValue(f, kind, f.intValue(v.Int()))
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			err = e.writeIntValue(f, kind, v.Uint())
+		case reflect.Float32:
+			err = writeFixed32(e.w, math.Float32bits(float32(v.Float())))
+		case reflect.Float64:
+			err = writeFixed64(e.w, math.Float64bits(v.Float()))
+		case reflect.Bool:
+			if v.Bool() {
+				err = e.w.WriteByte(1)
+			} else {
+				err = e.w.WriteByte(0)
+			}
+		}
+	}
+	return err
+}
+
+// writeIntValue is like writeInt, but does not write the field key.
+func (e *Encoder) writeIntValue(f *fieldInfo, kind reflect.Kind, v uint64) error {
+	if !f.fixed {
+		return writeUvarint(e.w, v)
+	}
+	if fixedSize(kind) == 4 {
+		return writeFixed32(e.w, uint32(v))
+	}
+	return writeFixed64(e.w, v)
+}
+
+func (e *Encoder) writeKey(key int, wire int) error {
+	return writeUvarint(e.w, uint64(key)<<3|uint64(wire))
+}
+
 func (e *Encoder) writeUvarint(key int, v uint64) (err error) {
-	if err = e.w.WriteByte(byte(key)<<3 | wireVarint); err != nil {
+	if err = e.writeKey(key, wireVarint); err != nil {
 		return err
 	}
 	return writeUvarint(e.w, v)
 }
 
 func (e *Encoder) writeBool(key int, v bool) (err error) {
-	if err = e.w.WriteByte(byte(key)<<3 | wireVarint); err != nil {
+	if err = e.writeKey(key, wireVarint); err != nil {
 		return err
 	}
 	if v {
@@ -227,21 +634,21 @@ func (e *Encoder) writeBool(key int, v bool) (err error) {
 }
 
 func (e *Encoder) writeFixed32(key int, v uint32) (err error) {
-	if err = e.w.WriteByte(byte(key)<<3 | wireFixed32); err != nil {
+	if err = e.writeKey(key, wireFixed32); err != nil {
 		return err
 	}
 	return writeFixed32(e.w, v)
 }
 
 func (e *Encoder) writeFixed64(key int, v uint64) (err error) {
-	if err = e.w.WriteByte(byte(key)<<3 | wireFixed64); err != nil {
+	if err = e.writeKey(key, wireFixed64); err != nil {
 		return err
 	}
 	return writeFixed64(e.w, v)
 }
 
 func (e *Encoder) writeBytes(key int, v []byte) (err error) {
-	if err = e.w.WriteByte(byte(key)<<3 | wireBytes); err != nil {
+	if err = e.writeKey(key, wireBytes); err != nil {
 		return err
 	}
 	if err = writeUvarint(e.w, uint64(len(v))); err != nil {
@@ -252,7 +659,10 @@ func (e *Encoder) writeBytes(key int, v []byte) (err error) {
 }
 
 func (e *Encoder) writeString(key int, v string) (err error) {
-	if err = e.w.WriteByte(byte(key)<<3 | wireBytes); err != nil {
+	if !e.opts.AllowInvalidUTF8 && !utf8.ValidString(v) {
+		return fmt.Errorf("field %d: %w", key, ErrInvalidUTF8)
+	}
+	if err = e.writeKey(key, wireBytes); err != nil {
 		return err
 	}
 	if err = writeUvarint(e.w, uint64(len(v))); err != nil {
@@ -263,13 +673,48 @@ func (e *Encoder) writeString(key int, v string) (err error) {
 }
 
 func (e *Encoder) writeStruct(key int, v reflect.Value) (err error) {
-	if err = e.w.WriteByte(byte(key)<<3 | wireBytes); err != nil {
+	if getStructInfo(v.Type()).marshaler {
+		// marshal once and fail before anything is written
+		b, err := marshal(v)
+		if err != nil {
+			return err
+		}
+		return e.writeBytes(key, b)
+	}
+
+	if err = e.writeKey(key, wireBytes); err != nil {
 		return err
 	}
 
-	n := uint64(sizeStruct(v, v.NumField()))
-	if err = writeUvarint(e.w, n); err != nil {
+	n := sizeStruct(v)
+	if err = writeUvarint(e.w, uint64(n)); err != nil {
 		return err
 	}
-	return e.encodeStruct(v, v.NumField())
+	start := e.written()
+	if err = e.encodeStruct(v); err != nil {
+		return err
+	}
+	return e.checkSize(v.Type(), start, n)
+}
+
+// written returns the number of bytes written so far, or -1 if the
+// encoder does not write into a buffer, as Marshal and Encode do.
+func (e *Encoder) written() int {
+	if b, ok := e.w.(*buffer); ok {
+		return len(*b)
+	}
+	return -1
+}
+
+// checkSize verifies that a message of type t, written from the offset
+// start, has the size announced by its length prefix. They differ if a
+// nested Marshaler without Sizer returns different bytes on every call.
+func (e *Encoder) checkSize(t reflect.Type, start, size int) error {
+	if start < 0 {
+		return nil
+	}
+	if n := e.written() - start; n != size {
+		return fmt.Errorf("%s: encoded %d bytes, size is %d", t, n, size)
+	}
+	return nil
 }
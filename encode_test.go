@@ -2,8 +2,10 @@ package protobuf
 
 import (
 	"bytes"
+	"math"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	testproto "github.com/mars9/protobuf/internal/proto"
@@ -19,8 +21,7 @@ func TestTypeEncode(t *testing.T) {
 		buf.Reset()
 
 		val := reflect.ValueOf(v)
-		fields := val.Elem().NumField()
-		if err := enc.encodeStruct(val.Elem(), fields); err != nil {
+		if err := enc.encodeStruct(val.Elem()); err != nil {
 			t.Fatalf("encode type: %v", err)
 		}
 
@@ -53,8 +54,7 @@ func TestSliceEncode(t *testing.T) {
 		buf.Reset()
 
 		val := reflect.ValueOf(v)
-		fields := val.Elem().NumField()
-		if err := enc.encodeStruct(val.Elem(), fields); err != nil {
+		if err := enc.encodeStruct(val.Elem()); err != nil {
 			t.Fatalf("encode slice: %v", err)
 		}
 
@@ -88,8 +88,7 @@ func TestStructEncode(t *testing.T) {
 		buf.Reset()
 
 		val := reflect.ValueOf(v)
-		fields := val.Elem().NumField()
-		if err := enc.encodeStruct(val.Elem(), fields); err != nil {
+		if err := enc.encodeStruct(val.Elem()); err != nil {
 			t.Fatalf("encode struct: %v", err)
 		}
 
@@ -112,3 +111,283 @@ func TestStructEncode(t *testing.T) {
 		}
 	}
 }
+
+type testItem struct {
+	Sku   string
+	Count int32
+}
+
+type testOrder struct {
+	Items    []testItem
+	Pointers []*testItem
+	ID       uint64
+}
+
+func TestMessageSliceEncode(t *testing.T) {
+	t.Parallel()
+
+	v := &testOrder{
+		Items:    []testItem{{Sku: "a", Count: 1}, {}, {Sku: "c", Count: 3}},
+		Pointers: []*testItem{{Sku: "d"}, {Count: -5}},
+		ID:       42,
+	}
+
+	data, err := Marshal(nil, v)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if n := sizeStruct(reflect.ValueOf(v).Elem()); n != len(data) {
+		t.Fatalf("message slice: expected size %d, got %d", len(data), n)
+	}
+
+	m := &testOrder{}
+	if err = Unmarshal(data, m); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(v, m) {
+		t.Fatalf("message slice: expected %#v, got %#v", v, m)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err = NewEncoder(buf, 0).Encode(v); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	m = &testOrder{}
+	if err = NewDecoder(buf, 0).Decode(m); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !reflect.DeepEqual(v, m) {
+		t.Fatalf("message slice: expected %#v, got %#v", v, m)
+	}
+}
+
+func TestNilMessageSliceEncode(t *testing.T) {
+	t.Parallel()
+
+	v := &testOrder{Pointers: []*testItem{{Sku: "a"}, nil}}
+	if _, err := Marshal(nil, v); err == nil {
+		t.Fatalf("marshal nil element: expected error")
+	}
+}
+
+type zigzagMessage struct {
+	Int32  int32   `protobuf:"zigzag32,1,opt,name=int32,proto3"`
+	Int64  int64   `protobuf:"zigzag64,2,opt,name=int64,proto3"`
+	Int32s []int32 `protobuf:"zigzag32,3,rep,name=int32s"`
+	Int64s []int64 `protobuf:"zigzag64,4,rep,name=int64s"`
+}
+
+func (m *zigzagMessage) Reset()         { *m = zigzagMessage{} }
+func (m *zigzagMessage) String() string { return proto.CompactTextString(m) }
+func (*zigzagMessage) ProtoMessage()    {}
+
+func TestZigZagEncode(t *testing.T) {
+	t.Parallel()
+
+	for _, v := range []*zigzagMessage{
+		&zigzagMessage{},
+		&zigzagMessage{Int32: -1, Int64: -1},
+		&zigzagMessage{Int32: math.MinInt32, Int64: math.MinInt64},
+		&zigzagMessage{Int32: math.MaxInt32, Int64: math.MaxInt64},
+		&zigzagMessage{
+			Int32s: []int32{0, -1, 1, math.MinInt32, math.MaxInt32},
+			Int64s: []int64{0, -1, 1, math.MinInt64, math.MaxInt64},
+		},
+	} {
+		data, err := Marshal(nil, v)
+		if err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+		if n := sizeStruct(reflect.ValueOf(v).Elem()); n != len(data) {
+			t.Fatalf("zigzag size: expected size %d, got %d", len(data), n)
+		}
+		if v.Int32s == nil {
+			pdata, err := proto.Marshal(v)
+			if err != nil {
+				t.Fatalf("marshal protobuf: %v", err)
+			}
+			if !bytes.Equal(pdata, data) {
+				t.Fatalf("zigzag encode: expected bytes %q, got %q", pdata, data)
+			}
+		}
+
+		pm := &zigzagMessage{}
+		if err = proto.Unmarshal(data, pm); err != nil {
+			t.Fatalf("unmarshal protobuf: %v", err)
+		}
+		if !reflect.DeepEqual(v, pm) {
+			t.Fatalf("zigzag encode: expected %#v, got %#v", v, pm)
+		}
+
+		xm := &zigzagMessage{}
+		if err = Unmarshal(data, xm); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		if !reflect.DeepEqual(v, xm) {
+			t.Fatalf("zigzag decode: expected %#v, got %#v", v, xm)
+		}
+	}
+
+	if _, err := Marshal(nil, &struct {
+		Uint64 uint64 `protobuf:"1,zigzag"`
+	}{}); err == nil {
+		t.Fatalf("marshal zigzag uint64: expected error")
+	}
+}
+
+type fixedMessage struct {
+	Uint32  uint32   `protobuf:"fixed32,1,opt,name=uint32,proto3"`
+	Uint64  uint64   `protobuf:"fixed64,2,opt,name=uint64,proto3"`
+	Int32   int32    `protobuf:"fixed32,3,opt,name=int32,proto3"`
+	Int64   int64    `protobuf:"fixed64,4,opt,name=int64,proto3"`
+	Uint32s []uint32 `protobuf:"fixed32,5,rep,name=uint32s"`
+	Uint64s []uint64 `protobuf:"fixed64,6,rep,name=uint64s"`
+	Int32s  []int32  `protobuf:"fixed32,7,rep,name=int32s"`
+	Int64s  []int64  `protobuf:"fixed64,8,rep,name=int64s"`
+}
+
+func (m *fixedMessage) Reset()         { *m = fixedMessage{} }
+func (m *fixedMessage) String() string { return proto.CompactTextString(m) }
+func (*fixedMessage) ProtoMessage()    {}
+
+func TestFixedEncode(t *testing.T) {
+	t.Parallel()
+
+	for _, v := range []*fixedMessage{
+		&fixedMessage{},
+		&fixedMessage{Uint32: 1, Uint64: 2, Int32: -3, Int64: -4},
+		&fixedMessage{
+			Uint32: math.MaxUint32,
+			Uint64: math.MaxUint64,
+			Int32:  math.MinInt32,
+			Int64:  math.MinInt64,
+		},
+		&fixedMessage{
+			Uint32s: []uint32{0, 1, math.MaxUint32},
+			Uint64s: []uint64{0, 1, math.MaxUint64},
+			Int32s:  []int32{0, -1, math.MinInt32, math.MaxInt32},
+			Int64s:  []int64{0, -1, math.MinInt64, math.MaxInt64},
+		},
+	} {
+		data, err := Marshal(nil, v)
+		if err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+		if n := sizeStruct(reflect.ValueOf(v).Elem()); n != len(data) {
+			t.Fatalf("fixed size: expected size %d, got %d", len(data), n)
+		}
+		if v.Uint32s == nil {
+			pdata, err := proto.Marshal(v)
+			if err != nil {
+				t.Fatalf("marshal protobuf: %v", err)
+			}
+			if !bytes.Equal(pdata, data) {
+				t.Fatalf("fixed encode: expected bytes %q, got %q", pdata, data)
+			}
+		}
+
+		pm := &fixedMessage{}
+		if err = proto.Unmarshal(data, pm); err != nil {
+			t.Fatalf("unmarshal protobuf: %v", err)
+		}
+		if !reflect.DeepEqual(v, pm) {
+			t.Fatalf("fixed encode: expected %#v, got %#v", v, pm)
+		}
+
+		xm := &fixedMessage{}
+		if err = Unmarshal(data, xm); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		if !reflect.DeepEqual(v, xm) {
+			t.Fatalf("fixed decode: expected %#v, got %#v", v, xm)
+		}
+	}
+
+	if _, err := Marshal(nil, &struct {
+		String string `protobuf:"1,fixed"`
+	}{}); err == nil {
+		t.Fatalf("marshal fixed string: expected error")
+	}
+}
+
+type presenceMessage struct {
+	Int32   *int32   `protobuf:"1"`
+	Uint64  *uint64  `protobuf:"2,fixed"`
+	Float64 *float64 `protobuf:"3"`
+	Bool    *bool    `protobuf:"4"`
+	String  *string  `protobuf:"5"`
+	Unset   *int64   `protobuf:"6"`
+}
+
+func TestPointerPresence(t *testing.T) {
+	t.Parallel()
+
+	var (
+		i32 int32
+		u64 uint64
+		f64 float64
+		b   bool
+		s   string
+	)
+	v := &presenceMessage{Int32: &i32, Uint64: &u64, Float64: &f64, Bool: &b, String: &s}
+
+	data, err := Marshal(nil, v)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	expected := []byte{
+		1 << 3, 0,
+		2<<3 | wireFixed64, 0, 0, 0, 0, 0, 0, 0, 0,
+		3<<3 | wireFixed64, 0, 0, 0, 0, 0, 0, 0, 0,
+		4 << 3, 0,
+		5<<3 | wireBytes, 0,
+	}
+	if !bytes.Equal(expected, data) {
+		t.Fatalf("pointer presence: expected bytes %v, got %v", expected, data)
+	}
+	if n := sizeStruct(reflect.ValueOf(v).Elem()); n != len(data) {
+		t.Fatalf("pointer presence: expected size %d, got %d", len(data), n)
+	}
+
+	m := &presenceMessage{}
+	if err = Unmarshal(data, m); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(v, m) {
+		t.Fatalf("pointer presence: expected %#v, got %#v", v, m)
+	}
+	if m.Unset != nil {
+		t.Fatalf("pointer presence: expected nil, got %v", *m.Unset)
+	}
+}
+
+func TestEncodeFailure(t *testing.T) {
+	t.Parallel()
+
+	buf := bytes.NewBuffer(nil)
+	enc := NewEncoder(buf, 0)
+	for _, v := range []interface{}{
+		&utf8Message{Name: "\xff"},
+		&testOrder{Pointers: []*testItem{nil}},
+		&timeMessage{Time: time.Date(10000, 1, 1, 0, 0, 0, 0, time.UTC)},
+	} {
+		if err := enc.Encode(v); err == nil {
+			t.Fatalf("encode %#v: expected error", v)
+		}
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("encode failure: expected no data, got %v", buf.Bytes())
+	}
+
+	expected := &testItem{Sku: "ok", Count: 7}
+	if err := enc.Encode(expected); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	m := &testItem{}
+	if err := NewDecoder(buf, 0).Decode(m); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !reflect.DeepEqual(expected, m) {
+		t.Fatalf("decode: expected %#v, got %#v", expected, m)
+	}
+}
@@ -0,0 +1,84 @@
+package protobuf
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// Errors reported by the encoder and decoder. Decoding errors are
+// typically wrapped in a *DecodeError. They can be tested with errors.Is.
+var (
+	ErrTooLarge        = errors.New("message too large")
+	ErrTruncated       = errors.New("unexpected end of data")
+	ErrOverflow        = errors.New("value overflow")
+	ErrInvalidWireType = errors.New("invalid wire type")
+	ErrLimit           = errors.New("decode limit exceeded")
+	ErrInvalidUTF8     = errors.New("invalid UTF-8")
+)
+
+// DecodeError describes malformed input found while decoding a message.
+type DecodeError struct {
+	Offset int    // byte offset of the field key in the message data
+	Field  int    // field number, 0 if the field key is invalid
+	Wire   int    // wire type of the field
+	Path   string // Go field path, such as "Order.Items[3].Sku"
+	Err    error  // underlying error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%s: field %d, wire type %d, offset %d: %v",
+		e.Path, e.Field, e.Wire, e.Offset, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// uvarintError returns the error of binary.Uvarint for the result n.
+func uvarintError(n int) error {
+	if n == 0 {
+		return ErrTruncated
+	}
+	return ErrOverflow
+}
+
+// fieldError returns err of the field f, whose key starts at the offset
+// start and whose value at the offset off, as a *DecodeError. A
+// *DecodeError of a nested message is moved into the field, index is the
+// element index of a repeated field or -1.
+func fieldError(err error, f *fieldInfo, index, start, off int, num, wire uint64) error {
+	de, ok := err.(*DecodeError)
+	if !ok {
+		return &DecodeError{Offset: start, Field: int(num), Wire: int(wire), Path: f.name, Err: err}
+	}
+
+	name := f.name
+	if index >= 0 {
+		name += "[" + strconv.Itoa(index) + "]"
+	}
+	de.Offset += off
+	de.Path = joinPath(name, de.Path)
+	return de
+}
+
+// rootError prefixes the path of a *DecodeError with the name of the
+// decoded struct type t.
+func rootError(t reflect.Type, err error) error {
+	if de, ok := err.(*DecodeError); ok {
+		de.Path = joinPath(t.Name(), de.Path)
+	}
+	return err
+}
+
+func joinPath(parent, path string) string {
+	if parent == "" {
+		return path
+	}
+	if path == "" {
+		return parent
+	}
+	return parent + "." + path
+}
@@ -0,0 +1,130 @@
+package protobuf
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+
+	testproto "github.com/mars9/protobuf/internal/proto"
+)
+
+func TestDecodeErrorPath(t *testing.T) {
+	t.Parallel()
+
+	v := &testOrder{Items: []testItem{{Sku: "a"}, {Sku: "b"}, {Sku: "c"}}}
+	data, err := Marshal(nil, v)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	offset := len(data) + 5
+	// fourth item with a truncated Count varint after its Sku
+	data = append(data, 1<<3|wireBytes, 5, 1<<3|wireBytes, 1, 'd', 2<<3|wireVarint, 0x80)
+
+	err = Unmarshal(data, &testOrder{})
+	de, ok := err.(*DecodeError)
+	if !ok {
+		t.Fatalf("decode error: expected *DecodeError, got %#v", err)
+	}
+	expected := &DecodeError{
+		Offset: offset,
+		Field:  2,
+		Wire:   wireVarint,
+		Path:   "testOrder.Items[3].Count",
+		Err:    ErrTruncated,
+	}
+	if !reflect.DeepEqual(expected, de) {
+		t.Fatalf("decode error: expected %#v, got %#v", expected, de)
+	}
+	if !errors.Is(err, ErrTruncated) {
+		t.Fatalf("decode error: expected ErrTruncated, got %v", err)
+	}
+}
+
+func TestDecodeErrorSentinels(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		data   []byte
+		v      interface{}
+		target error
+	}{
+		{[]byte{1<<3 | wireBytes, 10, 'a'}, &testItem{}, ErrTruncated},
+		{[]byte{1<<3 | wireBytes, 0xff, 0xff, 0xff, 0xff, 0x0f}, &testItem{}, ErrTruncated},
+		{[]byte{2<<3 | wireFixed64, 1, 2, 3}, &testItem{}, ErrTruncated},
+		{[]byte{1<<3 | wireStartGroup, 2<<3 | wireVarint, 1}, &testItem{}, ErrTruncated},
+		{[]byte{2<<3 | wireVarint, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 1}, &testItem{}, ErrOverflow},
+		{[]byte{2<<3 | wireVarint, 0x80, 0x80, 0x80, 0x80, 0x10}, &testItem{}, ErrOverflow},
+		{[]byte{5<<3 | wireVarint, 0x80, 0x02}, &intKinds{}, ErrOverflow},
+		{[]byte{2<<3 | 6}, &testItem{}, ErrInvalidWireType},
+		{[]byte{9<<3 | wireEndGroup}, &testItem{}, ErrInvalidWireType},
+	} {
+		err := Unmarshal(test.data, test.v)
+		if !errors.Is(err, test.target) {
+			t.Fatalf("unmarshal %v: expected %v, got %v", test.data, test.target, err)
+		}
+		if _, ok := err.(*DecodeError); !ok {
+			t.Fatalf("unmarshal %v: expected *DecodeError, got %#v", test.data, err)
+		}
+	}
+
+	buf := bytes.NewBuffer([]byte{0x80, 0x01})
+	if err := NewDecoder(buf, 100).Decode(&testItem{}); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("decode: expected ErrTooLarge, got %v", err)
+	}
+	if err := NewEncoder(bytes.NewBuffer(nil), 1).Encode(&testItem{Sku: "abc"}); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("encode: expected ErrTooLarge, got %v", err)
+	}
+}
+
+// TestDecodeMalformed decodes truncated and randomly mutated encodings,
+// which must never panic.
+func TestDecodeMalformed(t *testing.T) {
+	t.Parallel()
+
+	rnd := rand.New(rand.NewSource(1))
+	messages := []interface{}{
+		&testOrder{Items: []testItem{{Sku: "a", Count: 1}}, Pointers: []*testItem{{Sku: "b"}}, ID: 3},
+		mapMessages[1],
+		&oneofMessage{ID: 1, Choice: &OneofMessage_Nested{Nested: &testproto.NestedStruct{Arg: 2}}},
+		&arrayMessage{ID: [16]byte{1}, Vector: [3]float64{1, 2, 3}, Names: [2]string{"a"}},
+		&intKinds{Int8: -1, Ints: []int{1, 2}, Uints: []uint16{3}},
+		&timeMessage{Time: time.Unix(1, 2)},
+		&durationMessage{Duration: time.Second},
+		&wrapperMessage{String: new(string)},
+		&valueMessage{List: []interface{}{1.0, "a", map[string]interface{}{"b": nil}}},
+		&codecMessage{ID: 1, Amount: big.NewInt(1)},
+		&pointMessage{Path: []*point{{X: 1}}},
+	}
+	for _, v := range messages {
+		data, err := Marshal(nil, v)
+		if err != nil {
+			t.Fatalf("marshal %T: %v", v, err)
+		}
+
+		inputs := make([][]byte, 0, len(data)+100)
+		for i := 0; i < len(data); i++ {
+			inputs = append(inputs, data[:i])
+		}
+		for i := 0; i < 100 && len(data) > 0; i++ {
+			b := append([]byte(nil), data...)
+			b[rnd.Intn(len(b))] = byte(rnd.Intn(256))
+			inputs = append(inputs, b)
+		}
+
+		typ := reflect.TypeOf(v).Elem()
+		for _, b := range inputs {
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						t.Fatalf("unmarshal %T %v: panic: %v", v, b, r)
+					}
+				}()
+				Unmarshal(b, reflect.New(typ).Interface())
+			}()
+		}
+	}
+}
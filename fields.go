@@ -0,0 +1,448 @@
+package protobuf
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxFieldNumber is the largest valid Protocol Buffer field number.
+const maxFieldNumber = 1<<29 - 1
+
+// fieldInfo describes how a struct field maps onto a Protocol Buffer
+// field.
+type fieldInfo struct {
+	index  int // struct field index
+	num    int // Protocol Buffer field number
+	name   string
+	zigzag bool // signed integers are ZigZag encoded (sint32, sint64)
+	fixed  bool // integers are fixed-width encoded (fixed32, sfixed64, ...)
+
+	unpacked bool // repeated scalars are written with one key per element
+	unixnano bool // time.Time is a varint of nanoseconds since the Unix epoch
+	wrapped  bool // pointer scalar is a wrapper message (Int64Value, ...)
+
+	oneof   []fieldInfo  // cases of a oneof interface field
+	wrapper reflect.Type // oneof wrapper type of a oneof case
+	inner   int          // wrapper struct field index of a oneof case
+}
+
+// mapKeyField and mapValueField describe the key and value fields of a
+// map entry message.
+var (
+	mapKeyField   = fieldInfo{num: 1, name: "key"}
+	mapValueField = fieldInfo{num: 2, name: "value"}
+)
+
+// intValue returns the varint value of the signed integer v.
+func (f *fieldInfo) intValue(v int64) uint64 {
+	if f.zigzag {
+		return encodeZigZag(v)
+	}
+	return uint64(v)
+}
+
+// UnknownFields holds the raw encoding of fields that a struct does not
+// know about. If a struct has a field of type UnknownFields, or a []byte
+// field named XXX_unrecognized, the key and value bytes of all unknown
+// fields are kept there on decode and written back unchanged on encode.
+type UnknownFields []byte
+
+var (
+	unknownFieldsType = reflect.TypeOf(UnknownFields(nil))
+	bytesType         = reflect.TypeOf([]byte(nil))
+)
+
+// structInfo holds the encodable fields of a struct type in struct field
+// order.
+type structInfo struct {
+	fields  []fieldInfo
+	nums    map[int]*fieldInfo // field number to field or oneof case
+	unknown int                // struct field index of the unknown fields or -1
+	err     error
+
+	marshaler   bool // pointer to the struct implements Marshaler
+	unmarshaler bool // pointer to the struct implements Unmarshaler
+}
+
+// lookup returns the field or oneof case with the field number num or nil
+// if the struct has no such field.
+func (s *structInfo) lookup(num int) *fieldInfo {
+	return s.nums[num]
+}
+
+var structCache sync.Map // map[reflect.Type]*structInfo
+
+// getStructInfo returns the cached field information of the struct type t.
+func getStructInfo(t reflect.Type) *structInfo {
+	if v, ok := structCache.Load(t); ok {
+		return v.(*structInfo)
+	}
+	v, _ := structCache.LoadOrStore(t, newStructInfo(t))
+	return v.(*structInfo)
+}
+
+// newStructInfo builds the field information of the struct type t.
+//
+// Field numbers are taken from the protobuf struct tag. A struct without
+// any protobuf tags falls back to positional numbering, where the field
+// number is the struct field index plus one. If a struct has at least
+// one tagged field, all untagged fields are ignored. A field tagged with
+// "-" is always ignored.
+//
+// An interface field is a oneof, whose cases are the wrapper types
+// registered with RegisterOneof. In a tagged struct a oneof field is
+// marked with the protobuf_oneof tag. Fields of type interface{},
+// []interface{} and map[string]interface{} are not oneofs, but
+// google.protobuf.Value, ListValue and Struct messages.
+//
+// The fields of a struct, whose pointer implements both Marshaler and
+// Unmarshaler, are not inspected.
+func newStructInfo(t reflect.Type) *structInfo {
+	tagged := false
+	for i := 0; i < t.NumField(); i++ {
+		if tag, ok := t.Field(i).Tag.Lookup("protobuf"); ok && tag != "-" {
+			tagged = true
+			break
+		}
+		if _, ok := t.Field(i).Tag.Lookup("protobuf_oneof"); ok {
+			tagged = true
+			break
+		}
+	}
+
+	info := &structInfo{
+		nums:        make(map[int]*fieldInfo),
+		unknown:     -1,
+		marshaler:   reflect.PtrTo(t).Implements(marshalerType),
+		unmarshaler: reflect.PtrTo(t).Implements(unmarshalerType),
+	}
+	if info.marshaler && info.unmarshaler {
+		return info // fields are never used
+	}
+
+	names := make(map[int]string) // field number to struct field name
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" { // unexported
+			continue
+		}
+
+		if sf.Type == unknownFieldsType ||
+			sf.Name == "XXX_unrecognized" && sf.Type == bytesType {
+			if info.unknown >= 0 {
+				info.err = fmt.Errorf("%s.%s: multiple unknown fields", t, sf.Name)
+				return info
+			}
+			info.unknown = i
+			continue
+		}
+
+		tag, ok := sf.Tag.Lookup("protobuf")
+		_, oneof := sf.Tag.Lookup("protobuf_oneof")
+		if tag == "-" || tagged && !ok && !oneof {
+			continue
+		}
+
+		codec := lookupCodec(sf.Type) != nil
+		if sf.Type.Kind() == reflect.Interface && sf.Type != errorType && sf.Type != valueType && !codec {
+			cases := oneofCases(sf.Type)
+			if cases == nil {
+				info.err = fmt.Errorf("%s.%s: unsupported interface type %s", t, sf.Name, sf.Type)
+				return info
+			}
+
+			f := fieldInfo{index: i, name: sf.Name}
+			for _, c := range cases {
+				if name, dup := names[c.field.num]; dup {
+					info.err = fmt.Errorf("%s.%s: field number %d already used by %s",
+						t, sf.Name, c.field.num, name)
+					return info
+				}
+				names[c.field.num] = sf.Name
+
+				cf := c.field
+				cf.index, cf.inner, cf.wrapper = i, c.field.index, c.typ
+				f.oneof = append(f.oneof, cf)
+			}
+			info.fields = append(info.fields, f)
+			continue
+		}
+
+		if sf.Type.Kind() == reflect.Map && sf.Type != objectType && !codec {
+			if err := checkMap(sf.Type); err != nil {
+				info.err = fmt.Errorf("%s.%s: %v", t, sf.Name, err)
+				return info
+			}
+		}
+
+		if err := checkMarshaler(sf.Type); err != nil {
+			info.err = fmt.Errorf("%s.%s: %v", t, sf.Name, err)
+			return info
+		}
+
+		f := fieldInfo{index: i, num: i + 1, name: sf.Name}
+		if ok {
+			if err := parseTag(tag, &f); err != nil {
+				info.err = fmt.Errorf("%s.%s: %v", t, sf.Name, err)
+				return info
+			}
+			if err := checkOptions(sf.Type, &f); err != nil {
+				info.err = fmt.Errorf("%s.%s: %v", t, sf.Name, err)
+				return info
+			}
+		}
+		if f.num < 1 || f.num > maxFieldNumber {
+			info.err = fmt.Errorf("%s.%s: invalid field number %d", t, sf.Name, f.num)
+			return info
+		}
+		if name, dup := names[f.num]; dup {
+			info.err = fmt.Errorf("%s.%s: field number %d already used by %s",
+				t, sf.Name, f.num, name)
+			return info
+		}
+		names[f.num] = sf.Name
+
+		info.fields = append(info.fields, f)
+	}
+
+	for i := range info.fields {
+		f := &info.fields[i]
+		if f.oneof == nil {
+			info.nums[f.num] = f
+			continue
+		}
+		for j := range f.oneof {
+			info.nums[f.oneof[j].num] = &f.oneof[j]
+		}
+	}
+	return info
+}
+
+// oneofCase returns the case of the oneof field f for the wrapper type t
+// or nil if t is not a registered wrapper.
+func (f *fieldInfo) oneofCase(t reflect.Type) *fieldInfo {
+	for i := range f.oneof {
+		if f.oneof[i].wrapper == t {
+			return &f.oneof[i]
+		}
+	}
+	return nil
+}
+
+// parseTag parses a protobuf struct tag of the form "N[,option...]" into
+// f. Tags generated by protoc-gen-go, such as "varint,1,opt,name=foo",
+// are accepted as well. Unknown options are ignored.
+//
+// The supported options are:
+//
+//	zigzag    encode signed integers as ZigZag varints (sint32, sint64)
+//	fixed     encode integers with a fixed width of 4 or 8 bytes (fixed32,
+//	          fixed64, sfixed32, sfixed64)
+//	unpacked  encode repeated scalars with one key per element instead
+//	          of the packed encoding
+//	unixnano  encode time.Time as a varint of nanoseconds since the Unix
+//	          epoch instead of a google.protobuf.Timestamp message
+//	wrapper   encode a pointer scalar, string or bytes field as the
+//	          google.protobuf wrapper message (Int64Value, StringValue, ...)
+func parseTag(tag string, f *fieldInfo) error {
+	num := 0
+	for _, opt := range strings.Split(tag, ",") {
+		if n, err := strconv.Atoi(opt); err == nil {
+			if num != 0 {
+				return errors.New("multiple field numbers in tag")
+			}
+			if n == 0 {
+				return errors.New("invalid field number 0")
+			}
+			num = n
+			continue
+		}
+
+		switch opt {
+		case "zigzag", "zigzag32", "zigzag64":
+			f.zigzag = true
+		case "fixed", "fixed32", "fixed64", "sfixed32", "sfixed64":
+			f.fixed = true
+		case "unpacked":
+			f.unpacked = true
+		case "unixnano":
+			f.unixnano = true
+		case "wrapper":
+			f.wrapped = true
+		}
+	}
+	if num == 0 {
+		return errors.New("missing field number in tag")
+	}
+	f.num = num
+	return nil
+}
+
+// checkOptions verifies that the tag options of f apply to the struct
+// field type t.
+func checkOptions(t reflect.Type, f *fieldInfo) error {
+	if f.wrapped {
+		if t.Kind() != reflect.Ptr || !wrappable(t.Elem()) {
+			return fmt.Errorf("wrapper encoding not supported for %s", t)
+		}
+		if f.zigzag || f.fixed {
+			return errors.New("wrapper encoding excludes zigzag and fixed encoding")
+		}
+	}
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		if t.Kind() != reflect.Ptr && t.Elem().Kind() == reflect.Uint8 {
+			break // bytes
+		}
+		t = t.Elem()
+	}
+	if f.zigzag {
+		switch t.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		default:
+			return fmt.Errorf("zigzag encoding not supported for %s", t)
+		}
+	}
+	if f.fixed {
+		switch t.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		case reflect.Float32, reflect.Float64: // always fixed
+		default:
+			return fmt.Errorf("fixed encoding not supported for %s", t)
+		}
+	}
+	if f.zigzag && f.fixed {
+		return errors.New("zigzag and fixed encoding are exclusive")
+	}
+	if f.unpacked && !packable(t.Kind()) {
+		return fmt.Errorf("unpacked encoding not supported for %s", t)
+	}
+	if f.unixnano && t != timeType {
+		return fmt.Errorf("unixnano encoding not supported for %s", t)
+	}
+	return nil
+}
+
+// checkMarshaler verifies that only structs among t and its element and
+// key types implement Marshaler or Unmarshaler. Other types are encoded
+// by their kind and need a Codec instead.
+func checkMarshaler(t reflect.Type) error {
+	if lookupCodec(t) != nil {
+		return nil
+	}
+	pt := reflect.PtrTo(t)
+	if t.Kind() != reflect.Struct && (pt.Implements(marshalerType) || pt.Implements(unmarshalerType)) {
+		return fmt.Errorf("non-struct type %s implements Marshaler or Unmarshaler", t)
+	}
+	switch t.Kind() {
+	case reflect.Map:
+		if err := checkMarshaler(t.Key()); err != nil {
+			return err
+		}
+		return checkMarshaler(t.Elem())
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		return checkMarshaler(t.Elem())
+	}
+	return nil
+}
+
+// checkMap verifies that the map type t can be encoded as repeated map
+// entry messages.
+func checkMap(t reflect.Type) error {
+	switch t.Key().Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Bool, reflect.String:
+	default:
+		return fmt.Errorf("unsupported map key type %s", t.Key())
+	}
+
+	if lookupCodec(t.Elem()) != nil {
+		return nil
+	}
+	switch v := t.Elem(); v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64, reflect.Bool, reflect.String,
+		reflect.Struct:
+	case reflect.Slice, reflect.Array:
+		if v.Elem().Kind() != reflect.Uint8 {
+			return fmt.Errorf("unsupported map value type %s", v)
+		}
+	case reflect.Ptr:
+		if v.Elem().Kind() != reflect.Struct && v != durationPtrType {
+			return fmt.Errorf("unsupported map value type %s", v)
+		}
+	default:
+		return fmt.Errorf("unsupported map value type %s", v)
+	}
+	return nil
+}
+
+var mapEntryCache sync.Map // map[reflect.Type]reflect.Type
+
+// mapEntryType returns a struct type with the key and value fields of
+// the map entry message of the map type t.
+func mapEntryType(t reflect.Type) reflect.Type {
+	if v, ok := mapEntryCache.Load(t); ok {
+		return v.(reflect.Type)
+	}
+	entry := reflect.StructOf([]reflect.StructField{
+		{Name: "Key", Type: t.Key(), Tag: `protobuf:"1"`},
+		{Name: "Value", Type: t.Elem(), Tag: `protobuf:"2"`},
+	})
+	v, _ := mapEntryCache.LoadOrStore(t, entry)
+	return v.(reflect.Type)
+}
+
+var valueWrapperCache sync.Map // map[reflect.Type]reflect.Type
+
+// valueWrapperType returns a struct type with the value field of the
+// wrapper message of the type t.
+func valueWrapperType(t reflect.Type) reflect.Type {
+	if v, ok := valueWrapperCache.Load(t); ok {
+		return v.(reflect.Type)
+	}
+	w := reflect.StructOf([]reflect.StructField{
+		{Name: "Value", Type: t, Tag: `protobuf:"1"`},
+	})
+	v, _ := valueWrapperCache.LoadOrStore(t, w)
+	return v.(reflect.Type)
+}
+
+// wrapValue returns the wrapper message holding the value v.
+func wrapValue(v reflect.Value) reflect.Value {
+	w := reflect.New(valueWrapperType(v.Type())).Elem()
+	w.Field(0).Set(v)
+	return w
+}
+
+// wrappable reports whether values of the type t can be held by a wrapper
+// message.
+func wrappable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64, reflect.Bool, reflect.String:
+		return true
+	case reflect.Slice:
+		return t.Elem().Kind() == reflect.Uint8
+	}
+	return false
+}
+
+// packable reports whether repeated values of kind use the packed
+// encoding. Repeated uint8 values are bytes.
+func packable(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64, reflect.Bool:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,208 @@
+package protobuf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	testproto "github.com/mars9/protobuf/internal/proto"
+)
+
+func TestParseTag(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		tag string
+		num int
+		err bool
+	}{
+		{tag: "1", num: 1},
+		{tag: "536870911", num: maxFieldNumber},
+		{tag: "varint,7,opt,name=Bool,json=bool", num: 7},
+		{tag: "bytes,9,opt,name=Bytes,json=bytes,proto3", num: 9},
+		{tag: "", err: true},
+		{tag: "0", err: true},
+		{tag: "1,2", err: true},
+		{tag: "opt,name=foo", err: true},
+	} {
+		f := fieldInfo{}
+		err := parseTag(test.tag, &f)
+		if test.err {
+			if err == nil {
+				t.Fatalf("parse tag %q: expected error", test.tag)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("parse tag %q: %v", test.tag, err)
+		}
+		if f.num != test.num {
+			t.Fatalf("parse tag %q: expected field number %d, got %d", test.tag, test.num, f.num)
+		}
+	}
+}
+
+type taggedTypes struct {
+	Bytes   []byte `protobuf:"9"`
+	String  string `protobuf:"8"`
+	Ignored int64
+	Bool    bool    `protobuf:"7"`
+	Float64 float64 `protobuf:"6"`
+	Float32 float32 `protobuf:"5"`
+	Skipped int64   `protobuf:"-"`
+	Int64   int64   `protobuf:"4"`
+	Int32   int32   `protobuf:"3"`
+	Uint64  uint64  `protobuf:"2"`
+	Uint32  uint32  `protobuf:"1"`
+}
+
+func TestTaggedStruct(t *testing.T) {
+	t.Parallel()
+
+	v := &taggedTypes{
+		Bytes:   []byte("abc"),
+		String:  "def",
+		Ignored: 42,
+		Bool:    true,
+		Float64: 1.5,
+		Float32: 2.5,
+		Skipped: 42,
+		Int64:   -4,
+		Int32:   -3,
+		Uint64:  2,
+		Uint32:  1,
+	}
+
+	data, err := Marshal(nil, v)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if n := sizeStruct(reflect.ValueOf(v).Elem()); n != len(data) {
+		t.Fatalf("tagged size: expected size %d, got %d", len(data), n)
+	}
+
+	pm := &testproto.TypesMessage{}
+	if err = proto.Unmarshal(data, pm); err != nil {
+		t.Fatalf("unmarshal protobuf: %v", err)
+	}
+	expected := &testproto.TypesMessage{
+		Uint32:  1,
+		Uint64:  2,
+		Int32:   -3,
+		Int64:   -4,
+		Float32: 2.5,
+		Float64: 1.5,
+		Bool:    true,
+		String_: "def",
+		Bytes:   []byte("abc"),
+	}
+	if !reflect.DeepEqual(expected, pm) {
+		t.Fatalf("tagged struct: expected %#v, got %#v", expected, pm)
+	}
+
+	xm := &taggedTypes{}
+	if err = Unmarshal(data, xm); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	v.Ignored, v.Skipped = 0, 0
+	if !reflect.DeepEqual(v, xm) {
+		t.Fatalf("tagged struct: expected %#v, got %#v", v, xm)
+	}
+}
+
+type duplicateTag struct {
+	A int32 `protobuf:"1"`
+	B int32 `protobuf:"1"`
+}
+
+type invalidTag struct {
+	A int32 `protobuf:"536870912"`
+}
+
+func TestInvalidTags(t *testing.T) {
+	t.Parallel()
+
+	for _, v := range []interface{}{&duplicateTag{}, &invalidTag{}} {
+		if _, err := Marshal(nil, v); err == nil {
+			t.Fatalf("marshal %T: expected error", v)
+		}
+		if err := Unmarshal([]byte{8, 1}, v); err == nil {
+			t.Fatalf("unmarshal %T: expected error", v)
+		}
+	}
+}
+
+type largeFields struct {
+	A int32  `protobuf:"16"`
+	B string `protobuf:"2048"`
+	C bool   `protobuf:"536870911"`
+}
+
+type manyFields struct {
+	F1, F2, F3, F4, F5, F6, F7, F8, F9, F10          int32
+	F11, F12, F13, F14, F15, F16, F17, F18, F19, F20 string
+	F21, F22, F23, F24, F25, F26, F27, F28, F29, F30 uint64
+	F31, F32, F33, F34, F35, F36, F37, F38, F39, F40 []byte
+}
+
+func TestLargeFieldNumbers(t *testing.T) {
+	t.Parallel()
+
+	v := &largeFields{A: 1, B: "b", C: true}
+	data, err := Marshal(nil, v)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	var expected []byte
+	for _, field := range []struct {
+		key   uint64
+		value []byte
+	}{
+		{16<<3 | wireVarint, []byte{1}},
+		{2048<<3 | wireBytes, []byte{1, 'b'}},
+		{maxFieldNumber<<3 | wireVarint, []byte{1}},
+	} {
+		buf := make([]byte, binary.MaxVarintLen64)
+		n := binary.PutUvarint(buf, field.key)
+		expected = append(expected, buf[:n]...)
+		expected = append(expected, field.value...)
+	}
+	if !bytes.Equal(expected, data) {
+		t.Fatalf("large field numbers: expected bytes %q, got %q", expected, data)
+	}
+	if n := sizeStruct(reflect.ValueOf(v).Elem()); n != len(data) {
+		t.Fatalf("large field numbers: expected size %d, got %d", len(data), n)
+	}
+
+	m := &largeFields{}
+	if err = Unmarshal(data, m); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(v, m) {
+		t.Fatalf("large field numbers: expected %#v, got %#v", v, m)
+	}
+}
+
+func TestManyFields(t *testing.T) {
+	t.Parallel()
+
+	v := &manyFields{F1: -1, F15: "15", F16: "16", F17: "17", F30: 30, F40: []byte("40")}
+	data, err := Marshal(nil, v)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if n := sizeStruct(reflect.ValueOf(v).Elem()); n != len(data) {
+		t.Fatalf("many fields: expected size %d, got %d", len(data), n)
+	}
+
+	m := &manyFields{}
+	if err = Unmarshal(data, m); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(v, m) {
+		t.Fatalf("many fields: expected %#v, got %#v", v, m)
+	}
+}
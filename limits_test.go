@@ -0,0 +1,143 @@
+package protobuf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+type limitMessage struct {
+	Packed  []int64          `protobuf:"1"`
+	Strings []string         `protobuf:"2"`
+	Map     map[string]int64 `protobuf:"3"`
+	Child   *limitMessage    `protobuf:"4"`
+}
+
+// nestedData returns a message with a nesting depth of depth, including
+// the root message.
+func nestedData(depth int) []byte {
+	var rev []byte // built back to front
+	var buf [binary.MaxVarintLen64]byte
+	for i := 1; i < depth; i++ {
+		n := binary.PutUvarint(buf[:], uint64(len(rev)))
+		for j := n - 1; j >= 0; j-- {
+			rev = append(rev, buf[j])
+		}
+		rev = append(rev, 4<<3|wireBytes)
+	}
+	data := make([]byte, len(rev))
+	for i, b := range rev {
+		data[len(rev)-1-i] = b
+	}
+	return data
+}
+
+func TestDecodeDepthLimit(t *testing.T) {
+	t.Parallel()
+
+	if err := Unmarshal(nestedData(100), &limitMessage{}); err != nil {
+		t.Fatalf("unmarshal depth 100: %v", err)
+	}
+	err := UnmarshalOptions{MaxDepth: 10}.Unmarshal(nestedData(10), &limitMessage{})
+	if err != nil {
+		t.Fatalf("unmarshal depth 10: %v", err)
+	}
+	err = UnmarshalOptions{MaxDepth: 10}.Unmarshal(nestedData(11), &limitMessage{})
+	if !errors.Is(err, ErrLimit) {
+		t.Fatalf("unmarshal depth 11: expected ErrLimit, got %v", err)
+	}
+	if _, ok := err.(*DecodeError); !ok {
+		t.Fatalf("unmarshal depth 11: expected *DecodeError, got %#v", err)
+	}
+	if err = Unmarshal(nestedData(defaultMaxDepth+1), &limitMessage{}); !errors.Is(err, ErrLimit) {
+		t.Fatalf("unmarshal default depth: expected ErrLimit, got %v", err)
+	}
+
+	// deeply nested unknown groups are skipped without recursion
+	var data []byte
+	for i := 0; i < 100000; i++ {
+		data = append(data, 9<<3|wireStartGroup)
+	}
+	for i := 0; i < 100000; i++ {
+		data = append(data, 9<<3|wireEndGroup)
+	}
+	if err = Unmarshal(data, &limitMessage{}); err != nil {
+		t.Fatalf("unmarshal nested groups: %v", err)
+	}
+}
+
+func TestDecodeElementLimit(t *testing.T) {
+	t.Parallel()
+
+	tests := []*limitMessage{
+		{Packed: []int64{1, 2, 3, 4}},
+		{Strings: []string{"a", "b", "c", "d"}},
+		{Map: map[string]int64{"a": 1, "b": 2, "c": 3, "d": 4}},
+		{Child: &limitMessage{Packed: []int64{1, 2, 3, 4}}},
+	}
+	for _, v := range tests {
+		data, err := Marshal(nil, v)
+		if err != nil {
+			t.Fatalf("marshal %#v: %v", v, err)
+		}
+		if err = (UnmarshalOptions{MaxElements: 4}).Unmarshal(data, &limitMessage{}); err != nil {
+			t.Fatalf("unmarshal %#v: %v", v, err)
+		}
+		err = UnmarshalOptions{MaxElements: 3}.Unmarshal(data, &limitMessage{})
+		if !errors.Is(err, ErrLimit) {
+			t.Fatalf("unmarshal %#v: expected ErrLimit, got %v", v, err)
+		}
+	}
+
+	// unpacked elements are counted across fields with the same number
+	data := []byte{1<<3 | wireVarint, 1, 1<<3 | wireBytes, 2, 2, 3}
+	err := UnmarshalOptions{MaxElements: 2}.Unmarshal(data, &limitMessage{})
+	if !errors.Is(err, ErrLimit) {
+		t.Fatalf("unmarshal mixed: expected ErrLimit, got %v", err)
+	}
+}
+
+func TestDecodeBytesLimit(t *testing.T) {
+	t.Parallel()
+
+	v := &limitMessage{Strings: []string{string(make([]byte, 40)), string(make([]byte, 40))}}
+	data, err := Marshal(nil, v)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if err = (UnmarshalOptions{MaxBytes: 200}).Unmarshal(data, &limitMessage{}); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	err = UnmarshalOptions{MaxBytes: 60}.Unmarshal(data, &limitMessage{})
+	if !errors.Is(err, ErrLimit) {
+		t.Fatalf("unmarshal: expected ErrLimit, got %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err = NewEncoder(buf, 0).Encode(v); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	dec := NewDecoder(buf, 0)
+	dec.SetOptions(UnmarshalOptions{MaxBytes: 60})
+	if err = dec.Decode(&limitMessage{}); !errors.Is(err, ErrLimit) {
+		t.Fatalf("decode: expected ErrLimit, got %v", err)
+	}
+}
+
+func TestDecodeBogusLength(t *testing.T) {
+	t.Parallel()
+
+	data := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x3f}
+	if err := NewDecoder(bytes.NewBuffer(data), 0).Decode(&limitMessage{}); !errors.Is(err, ErrTruncated) {
+		t.Fatalf("decode: expected ErrTruncated, got %v", err)
+	}
+	if err := NewDecoder(bytes.NewBuffer(data), 1<<20).Decode(&limitMessage{}); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("decode: expected ErrTooLarge, got %v", err)
+	}
+
+	data = []byte{3, 1 << 3, 1}
+	if err := NewDecoder(bytes.NewBuffer(data), 0).Decode(&limitMessage{}); !errors.Is(err, ErrTruncated) {
+		t.Fatalf("decode short: expected ErrTruncated, got %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+package protobuf
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	testproto "github.com/mars9/protobuf/internal/proto"
+)
+
+type mapMessage struct {
+	Strings  map[string]string                  `protobuf:"bytes,1,rep,name=strings" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Ints     map[int64]int32                    `protobuf:"bytes,2,rep,name=ints" protobuf_key:"varint,1,opt,name=key" protobuf_val:"varint,2,opt,name=value"`
+	Bytes    map[uint32][]byte                  `protobuf:"bytes,3,rep,name=bytes" protobuf_key:"varint,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Floats   map[bool]float64                   `protobuf:"bytes,4,rep,name=floats" protobuf_key:"varint,1,opt,name=key" protobuf_val:"fixed64,2,opt,name=value"`
+	Messages map[string]*testproto.NestedStruct `protobuf:"bytes,5,rep,name=messages" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+}
+
+func (m *mapMessage) Reset()         { *m = mapMessage{} }
+func (m *mapMessage) String() string { return proto.CompactTextString(m) }
+func (*mapMessage) ProtoMessage()    {}
+
+var mapMessages = []*mapMessage{
+	&mapMessage{},
+	&mapMessage{
+		Strings: map[string]string{"a": "b", "": "empty key", "empty value": ""},
+		Ints:    map[int64]int32{0: 0, -1: 1, 1 << 40: -1},
+		Bytes:   map[uint32][]byte{1: []byte("abc"), 2: []byte("def")},
+		Floats:  map[bool]float64{true: 1.5, false: 0},
+		Messages: map[string]*testproto.NestedStruct{
+			"a": &testproto.NestedStruct{Arg: 42},
+			"b": &testproto.NestedStruct{},
+		},
+	},
+}
+
+func TestMapEncode(t *testing.T) {
+	t.Parallel()
+
+	for _, v := range mapMessages {
+		data, err := Marshal(nil, v)
+		if err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+		if n, m := proto.Size(v), sizeStruct(reflect.ValueOf(v).Elem()); n != m || n != len(data) {
+			t.Fatalf("map size: expected size %d, got %d and %d bytes", n, m, len(data))
+		}
+
+		m := &mapMessage{}
+		if err = proto.Unmarshal(data, m); err != nil {
+			t.Fatalf("unmarshal protobuf: %v", err)
+		}
+		if !reflect.DeepEqual(v, m) {
+			t.Fatalf("map encode: expected %#v, got %#v", v, m)
+		}
+	}
+}
+
+func TestMapDecode(t *testing.T) {
+	t.Parallel()
+
+	for _, v := range mapMessages {
+		data, err := proto.Marshal(v)
+		if err != nil {
+			t.Fatalf("marshal protobuf: %v", err)
+		}
+
+		m := &mapMessage{}
+		if err = Unmarshal(data, m); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		if !reflect.DeepEqual(v, m) {
+			t.Fatalf("map decode: expected %#v, got %#v", v, m)
+		}
+	}
+
+	// missing key and value decode as zero values
+	m := &mapMessage{}
+	if err := Unmarshal([]byte{1<<3 | wireBytes, 0, 5<<3 | wireBytes, 0}, m); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	expected := &mapMessage{
+		Strings:  map[string]string{"": ""},
+		Messages: map[string]*testproto.NestedStruct{"": &testproto.NestedStruct{}},
+	}
+	if !reflect.DeepEqual(expected, m) {
+		t.Fatalf("map decode: expected %#v, got %#v", expected, m)
+	}
+}
+
+func TestMapDeterministic(t *testing.T) {
+	t.Parallel()
+
+	v := &struct {
+		Values map[string]int32
+	}{Values: make(map[string]int32)}
+	for _, k := range []string{"d", "b", "a", "e", "c", "f", "h", "g"} {
+		v.Values[k] = int32(k[0])
+	}
+
+	opts := MarshalOptions{Deterministic: true}
+	data, err := opts.Marshal(nil, v)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	for i := 0; i < 8; i++ {
+		xdata, err := opts.Marshal(nil, v)
+		if err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+		if !bytes.Equal(data, xdata) {
+			t.Fatalf("map deterministic: expected bytes %q, got %q", data, xdata)
+		}
+	}
+
+	buf := bytes.NewBuffer(nil)
+	enc := NewEncoder(buf, 0)
+	enc.SetOptions(opts)
+	if err = enc.Encode(v); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if !bytes.Equal(data, buf.Bytes()[1:]) {
+		t.Fatalf("map deterministic: expected bytes %q, got %q", data, buf.Bytes()[1:])
+	}
+}
+
+func TestInvalidMap(t *testing.T) {
+	t.Parallel()
+
+	for _, v := range []interface{}{
+		&struct{ M map[float64]int32 }{},
+		&struct{ M map[string][]int32 }{},
+		&struct{ M map[string]*int32 }{},
+	} {
+		if _, err := Marshal(nil, v); err == nil {
+			t.Fatalf("marshal %T: expected error", v)
+		}
+	}
+}
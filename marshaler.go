@@ -0,0 +1,80 @@
+package protobuf
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Marshaler is implemented by struct types that encode themselves into
+// the Protocol Buffer wire format. The returned bytes are the encoding of
+// the message without length prefix. Unless the type is a Sizer, they
+// must be the same on every call. Fields of other types implementing
+// Marshaler are rejected; use a Codec for them.
+type Marshaler interface {
+	MarshalProtobuf() ([]byte, error)
+}
+
+// Unmarshaler is implemented by struct types that decode themselves from
+// the Protocol Buffer wire format. UnmarshalProtobuf must copy the data
+// if it wishes to retain the data after returning.
+type Unmarshaler interface {
+	UnmarshalProtobuf(data []byte) error
+}
+
+// Sizer is optionally implemented by a Marshaler to return the length of
+// its encoding without calling MarshalProtobuf.
+type Sizer interface {
+	SizeProtobuf() int
+}
+
+var (
+	marshalerType   = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+)
+
+// addr returns a pointer to the struct val, which is copied if val is not
+// addressable.
+func addr(val reflect.Value) reflect.Value {
+	if val.CanAddr() {
+		return val.Addr()
+	}
+	p := reflect.New(val.Type())
+	p.Elem().Set(val)
+	return p
+}
+
+// sizeMarshaler returns the encoded size of the Marshaler struct val.
+func sizeMarshaler(val reflect.Value) int {
+	m := addr(val).Interface()
+	if s, ok := m.(Sizer); ok {
+		return s.SizeProtobuf()
+	}
+	b, err := m.(Marshaler).MarshalProtobuf()
+	if err != nil { // reported on encode
+		return 0
+	}
+	return len(b)
+}
+
+// marshal returns the encoding of the Marshaler struct val, whose length
+// must match its size, if it is a Sizer.
+func marshal(val reflect.Value) ([]byte, error) {
+	m := addr(val).Interface()
+	b, err := m.(Marshaler).MarshalProtobuf()
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := m.(Sizer); ok && s.SizeProtobuf() != len(b) {
+		return nil, fmt.Errorf("%s: marshaled %d bytes, size is %d", val.Type(), len(b), s.SizeProtobuf())
+	}
+	return b, nil
+}
+
+func (e *Encoder) writeMarshaler(val reflect.Value) error {
+	b, err := marshal(val)
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(b)
+	return err
+}
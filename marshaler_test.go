@@ -0,0 +1,223 @@
+package protobuf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// point encodes itself as two fixed32 fields.
+type point struct {
+	X, Y  int32
+	sizes *int // counts SizeProtobuf calls
+}
+
+func (p *point) MarshalProtobuf() ([]byte, error) {
+	if p.X < 0 {
+		return nil, errors.New("negative x")
+	}
+	b := make([]byte, 10)
+	b[0] = 1<<3 | wireFixed32
+	binary.LittleEndian.PutUint32(b[1:], uint32(p.X))
+	b[5] = 2<<3 | wireFixed32
+	binary.LittleEndian.PutUint32(b[6:], uint32(p.Y))
+	return b, nil
+}
+
+func (p *point) SizeProtobuf() int {
+	if p.sizes != nil {
+		*p.sizes++
+	}
+	return 10
+}
+
+func (p *point) UnmarshalProtobuf(data []byte) error {
+	if len(data) != 10 {
+		return errors.New("invalid point")
+	}
+	p.X = int32(binary.LittleEndian.Uint32(data[1:]))
+	p.Y = int32(binary.LittleEndian.Uint32(data[6:]))
+	return nil
+}
+
+type plainPoint struct {
+	X int32 `protobuf:"1,fixed"`
+	Y int32 `protobuf:"2,fixed"`
+}
+
+type pointMessage struct {
+	Origin point            `protobuf:"1"`
+	Path   []*point         `protobuf:"2"`
+	Named  map[string]point `protobuf:"3"`
+}
+
+type plainPointMessage struct {
+	Origin plainPoint            `protobuf:"1"`
+	Path   []*plainPoint         `protobuf:"2"`
+	Named  map[string]plainPoint `protobuf:"3"`
+}
+
+func TestMarshaler(t *testing.T) {
+	t.Parallel()
+
+	v := &pointMessage{
+		Origin: point{X: 1, Y: -1},
+		Path:   []*point{{X: 2}, {Y: 3}},
+		Named:  map[string]point{"a": {X: 4, Y: 5}},
+	}
+	pv := &plainPointMessage{
+		Origin: plainPoint{X: 1, Y: -1},
+		Path:   []*plainPoint{{X: 2}, {Y: 3}},
+		Named:  map[string]plainPoint{"a": {X: 4, Y: 5}},
+	}
+
+	data, err := Marshal(nil, v)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	expected, err := Marshal(nil, pv)
+	if err != nil {
+		t.Fatalf("marshal plain: %v", err)
+	}
+	// zero fields of a Marshaler are written
+	pm := &plainPointMessage{}
+	if err = Unmarshal(data, pm); err != nil {
+		t.Fatalf("unmarshal plain: %v", err)
+	}
+	if !reflect.DeepEqual(pv, pm) {
+		t.Fatalf("marshaler: expected %#v, got %#v", pv, pm)
+	}
+	if n := sizeStruct(reflect.ValueOf(v).Elem()); n != len(data) {
+		t.Fatalf("marshaler: expected size %d, got %d", len(data), n)
+	}
+
+	m := &pointMessage{}
+	if err = Unmarshal(data, m); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(v, m) {
+		t.Fatalf("marshaler: expected %#v, got %#v", v, m)
+	}
+	if m = (&pointMessage{}); Unmarshal(expected, m) == nil {
+		t.Fatalf("unmarshal plain encoding: expected error")
+	}
+}
+
+func TestMarshalerTopLevel(t *testing.T) {
+	t.Parallel()
+
+	sizes := 0
+	v := &point{X: 7, Y: 8, sizes: &sizes}
+	data, err := Marshal(nil, v)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	expected, err := v.MarshalProtobuf()
+	if err != nil {
+		t.Fatalf("marshal protobuf: %v", err)
+	}
+	if !bytes.Equal(expected, data) {
+		t.Fatalf("marshaler: expected bytes %v, got %v", expected, data)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err = NewEncoder(buf, 0).Encode(v); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if sizes == 0 {
+		t.Fatalf("marshaler: expected SizeProtobuf to be called")
+	}
+	m := &point{}
+	if err = NewDecoder(buf, 0).Decode(m); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if m.X != 7 || m.Y != 8 {
+		t.Fatalf("marshaler: expected %v, got %v", v, m)
+	}
+
+	if _, err = Marshal(nil, &point{X: -1}); err == nil {
+		t.Fatalf("marshal: expected error")
+	}
+	if err = Unmarshal([]byte{1}, &point{}); err == nil {
+		t.Fatalf("unmarshal: expected error")
+	}
+}
+
+func TestMarshalerFailure(t *testing.T) {
+	t.Parallel()
+
+	buf := bytes.NewBuffer(nil)
+	enc := NewEncoder(buf, 0)
+	for _, v := range []interface{}{
+		&point{X: -1},
+		&pointMessage{Origin: point{X: -1}},
+		&pointMessage{Path: []*point{{X: 1}, {X: -1}}},
+		&pointMessage{Named: map[string]point{"a": {X: -1}}},
+	} {
+		if err := enc.Encode(v); err == nil || err.Error() != "negative x" {
+			t.Fatalf("encode %#v: expected negative x error, got %v", v, err)
+		}
+		if _, err := Marshal(nil, v); err == nil {
+			t.Fatalf("marshal %#v: expected error", v)
+		}
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("encode failure: expected no data, got %v", buf.Bytes())
+	}
+}
+
+// growing is a Marshaler without Sizer, whose encoding grows on every
+// call.
+type growing struct {
+	n int
+}
+
+func (g *growing) MarshalProtobuf() ([]byte, error) {
+	g.n++
+	return bytes.Repeat([]byte{1 << 3, 1}, g.n), nil
+}
+
+type growingParent struct {
+	Child growing `protobuf:"1"`
+}
+
+type growingMessage struct {
+	Parent growingParent      `protobuf:"1"`
+	Map    map[string]growing `protobuf:"2"`
+}
+
+func TestMarshalerSizeMismatch(t *testing.T) {
+	t.Parallel()
+
+	for _, v := range []*growingMessage{
+		{Parent: growingParent{}},
+		{Map: map[string]growing{"a": {}}},
+	} {
+		if _, err := Marshal(nil, v); err == nil {
+			t.Fatalf("marshal %#v: expected size error", v)
+		}
+	}
+}
+
+type decimal string
+
+func (d decimal) MarshalProtobuf() ([]byte, error) { return []byte(d), nil }
+
+func TestMarshalerNonStruct(t *testing.T) {
+	t.Parallel()
+
+	for _, v := range []interface{}{
+		&struct {
+			D decimal `protobuf:"1"`
+		}{"1.5"},
+		&struct {
+			D map[string]*decimal `protobuf:"1"`
+		}{},
+	} {
+		if _, err := Marshal(nil, v); err == nil {
+			t.Fatalf("marshal %#v: expected error", v)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package protobuf
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+type mergeMessage struct {
+	ID     uint64            `protobuf:"1"`
+	Name   string            `protobuf:"2"`
+	Tags   []string          `protobuf:"3"`
+	Counts []int64           `protobuf:"4"`
+	Item   testItem          `protobuf:"5"`
+	Parent *testItem         `protobuf:"6"`
+	Attrs  map[string]string `protobuf:"7"`
+	Data   []byte            `protobuf:"8"`
+}
+
+func newMergeMessages() (dst, src, merged *mergeMessage) {
+	dst = &mergeMessage{
+		ID:     1,
+		Name:   "dst",
+		Tags:   []string{"a"},
+		Counts: []int64{1},
+		Item:   testItem{Sku: "x", Count: 1},
+		Parent: &testItem{Sku: "p"},
+		Attrs:  map[string]string{"k": "dst", "d": "dst"},
+		Data:   []byte("dst"),
+	}
+	src = &mergeMessage{
+		Name:   "src",
+		Tags:   []string{"b"},
+		Counts: []int64{2, 3},
+		Item:   testItem{Count: 2},
+		Parent: &testItem{Count: 3},
+		Attrs:  map[string]string{"k": "src", "s": "src"},
+		Data:   []byte("src"),
+	}
+	merged = &mergeMessage{
+		ID:     1,
+		Name:   "src",
+		Tags:   []string{"a", "b"},
+		Counts: []int64{1, 2, 3},
+		Item:   testItem{Sku: "x", Count: 2},
+		Parent: &testItem{Sku: "p", Count: 3},
+		Attrs:  map[string]string{"k": "src", "d": "dst", "s": "src"},
+		Data:   []byte("src"),
+	}
+	return dst, src, merged
+}
+
+func TestUnmarshalMerge(t *testing.T) {
+	t.Parallel()
+
+	dst, src, merged := newMergeMessages()
+	data, err := Marshal(nil, src)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if err = UnmarshalMerge(data, dst); err != nil {
+		t.Fatalf("unmarshal merge: %v", err)
+	}
+	if !reflect.DeepEqual(merged, dst) {
+		t.Fatalf("unmarshal merge: expected %#v, got %#v", merged, dst)
+	}
+
+	dst, src, _ = newMergeMessages()
+	if err = Unmarshal(data, dst); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(src, dst) {
+		t.Fatalf("unmarshal: expected %#v, got %#v", src, dst)
+	}
+
+	buf := &bytes.Buffer{}
+	enc := NewEncoder(buf, 0)
+	for i := 0; i < 2; i++ {
+		if err = enc.Encode(src); err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+	}
+	dst, src, merged = newMergeMessages()
+	dec := NewDecoder(buf, 0)
+	if err = dec.Decode(dst); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !reflect.DeepEqual(src, dst) {
+		t.Fatalf("decode: expected %#v, got %#v", src, dst)
+	}
+	dst, _, _ = newMergeMessages()
+	dec.SetOptions(UnmarshalOptions{Merge: true})
+	if err = dec.Decode(dst); err != nil {
+		t.Fatalf("decode merge: %v", err)
+	}
+	if !reflect.DeepEqual(merged, dst) {
+		t.Fatalf("decode merge: expected %#v, got %#v", merged, dst)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	t.Parallel()
+
+	dst, src, merged := newMergeMessages()
+	if err := Merge(dst, src); err != nil {
+		t.Fatalf("merge: %v", err)
+	}
+	if !reflect.DeepEqual(merged, dst) {
+		t.Fatalf("merge: expected %#v, got %#v", merged, dst)
+	}
+	if _, s, _ := newMergeMessages(); !reflect.DeepEqual(s, src) {
+		t.Fatalf("merge: expected src %#v, got %#v", s, src)
+	}
+
+	if err := Merge(dst, &testItem{}); err == nil {
+		t.Fatalf("merge: expected error for mismatched types")
+	}
+}
+
+func TestMergeValueTree(t *testing.T) {
+	t.Parallel()
+
+	dst := &valueMessage{
+		Object: map[string]interface{}{"a": 1.0, "k": "dst"},
+		List:   []interface{}{"a"},
+		Value:  map[string]interface{}{"x": true},
+	}
+	src := &valueMessage{
+		Object: map[string]interface{}{"b": 2.0, "k": "src"},
+		List:   []interface{}{"b", nil},
+		Value:  map[string]interface{}{"y": false},
+	}
+	expected := &valueMessage{
+		Object: map[string]interface{}{"a": 1.0, "b": 2.0, "k": "src"},
+		List:   []interface{}{"a", "b", nil},
+		Value:  map[string]interface{}{"x": true, "y": false},
+	}
+	if err := Merge(dst, src); err != nil {
+		t.Fatalf("merge: %v", err)
+	}
+	if !reflect.DeepEqual(expected, dst) {
+		t.Fatalf("merge: expected %#v, got %#v", expected, dst)
+	}
+
+	dst.Value = []interface{}{"list"}
+	if err := Merge(dst, &valueMessage{Value: "scalar"}); err != nil {
+		t.Fatalf("merge: %v", err)
+	}
+	if dst.Value != "scalar" {
+		t.Fatalf("merge: expected %#v, got %#v", "scalar", dst.Value)
+	}
+}
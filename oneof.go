@@ -0,0 +1,115 @@
+package protobuf
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// oneofCase describes a registered wrapper type of a oneof field.
+type oneofCase struct {
+	typ   reflect.Type // pointer to the wrapper struct
+	field fieldInfo    // wrapper struct field holding the value
+}
+
+var oneofRegistry sync.Map // map[reflect.Type][]oneofCase
+
+// oneofCases returns the registered cases of the oneof interface type t.
+func oneofCases(t reflect.Type) []oneofCase {
+	if v, ok := oneofRegistry.Load(t); ok {
+		return v.([]oneofCase)
+	}
+	return nil
+}
+
+// RegisterOneof registers the wrapper types of a oneof, which is
+// represented by an interface field. Iface is a nil pointer to the
+// interface type, each wrapper a nil pointer to a struct that implements
+// the interface and holds the value of one case in its single field.
+// The field number of that field identifies the case on the wire:
+//
+//	type isShape_Kind interface{ isShape_Kind() }
+//
+//	type Shape_Circle struct {
+//		Circle *Circle `protobuf:"2"`
+//	}
+//
+//	type Shape_Name struct {
+//		Name string `protobuf:"3"`
+//	}
+//
+//	func (*Shape_Circle) isShape_Kind() {}
+//	func (*Shape_Name) isShape_Kind()   {}
+//
+//	type Shape struct {
+//		ID   uint64       `protobuf:"1"`
+//		Kind isShape_Kind `protobuf_oneof:"kind"`
+//	}
+//
+//	func init() {
+//		protobuf.RegisterOneof((*isShape_Kind)(nil),
+//			(*Shape_Circle)(nil), (*Shape_Name)(nil))
+//	}
+//
+// A oneof field is encoded as the field of the wrapper it holds, even if
+// the value is zero. A nil interface is not encoded.
+//
+// RegisterOneof must be called before a struct with the oneof field is
+// encoded or decoded for the first time, typically in an init function.
+// It panics if the interface or a wrapper type is invalid.
+func RegisterOneof(iface interface{}, wrappers ...interface{}) {
+	it := reflect.TypeOf(iface)
+	if it == nil || it.Kind() != reflect.Ptr || it.Elem().Kind() != reflect.Interface {
+		panic("protobuf: oneof must be a pointer to an interface")
+	}
+	it = it.Elem()
+
+	cases := make([]oneofCase, 0, len(wrappers))
+	nums := make(map[int]bool)
+	for _, w := range wrappers {
+		wt := reflect.TypeOf(w)
+		if wt == nil || wt.Kind() != reflect.Ptr || wt.Elem().Kind() != reflect.Struct {
+			panic(fmt.Sprintf("protobuf: oneof wrapper %T must be a pointer to a struct", w))
+		}
+		if !wt.Implements(it) {
+			panic(fmt.Sprintf("protobuf: oneof wrapper %s does not implement %s", wt, it))
+		}
+
+		info := getStructInfo(wt.Elem())
+		if info.err != nil {
+			panic("protobuf: " + info.err.Error())
+		}
+		if len(info.fields) != 1 {
+			panic(fmt.Sprintf("protobuf: oneof wrapper %s must have exactly one field", wt))
+		}
+		f := info.fields[0]
+		if err := checkOneof(wt.Elem().Field(f.index).Type); err != nil {
+			panic(fmt.Sprintf("protobuf: oneof wrapper %s: %v", wt, err))
+		}
+		if nums[f.num] {
+			panic(fmt.Sprintf("protobuf: oneof wrapper %s: duplicate field number %d", wt, f.num))
+		}
+		nums[f.num] = true
+
+		cases = append(cases, oneofCase{typ: wt, field: f})
+	}
+
+	if _, dup := oneofRegistry.LoadOrStore(it, cases); dup {
+		panic(fmt.Sprintf("protobuf: oneof %s already registered", it))
+	}
+}
+
+// checkOneof verifies that a oneof case can hold a value of type t. A
+// case holds a single scalar, string, bytes or message value.
+func checkOneof(t reflect.Type) error {
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return nil
+		}
+	case reflect.Map, reflect.Interface:
+	default:
+		return nil
+	}
+	return fmt.Errorf("unsupported oneof type %s", t)
+}
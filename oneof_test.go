@@ -0,0 +1,298 @@
+package protobuf
+
+import (
+	"bytes"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	testproto "github.com/mars9/protobuf/internal/proto"
+)
+
+type isOneofMessage_Choice interface {
+	isOneofMessage_Choice()
+}
+
+type OneofMessage_Name struct {
+	Name string `protobuf:"bytes,2,opt,name=name,oneof"`
+}
+
+type OneofMessage_Count struct {
+	Count int64 `protobuf:"zigzag64,3,opt,name=count,oneof"`
+}
+
+type OneofMessage_Data struct {
+	Data []byte `protobuf:"bytes,4,opt,name=data,oneof"`
+}
+
+type OneofMessage_Nested struct {
+	Nested *testproto.NestedStruct `protobuf:"bytes,5,opt,name=nested,oneof"`
+}
+
+func (*OneofMessage_Name) isOneofMessage_Choice()   {}
+func (*OneofMessage_Count) isOneofMessage_Choice()  {}
+func (*OneofMessage_Data) isOneofMessage_Choice()   {}
+func (*OneofMessage_Nested) isOneofMessage_Choice() {}
+
+type oneofMessage struct {
+	ID     uint64                `protobuf:"varint,1,opt,name=id,proto3"`
+	Tail   string                `protobuf:"bytes,6,opt,name=tail,proto3"`
+	Choice isOneofMessage_Choice `protobuf_oneof:"choice"`
+}
+
+func (m *oneofMessage) Reset()         { *m = oneofMessage{} }
+func (m *oneofMessage) String() string { return proto.CompactTextString(m) }
+func (*oneofMessage) ProtoMessage()    {}
+
+func (*oneofMessage) XXX_OneofWrappers() []interface{} {
+	return []interface{}{
+		(*OneofMessage_Name)(nil),
+		(*OneofMessage_Count)(nil),
+		(*OneofMessage_Data)(nil),
+		(*OneofMessage_Nested)(nil),
+	}
+}
+
+func init() {
+	RegisterOneof((*isOneofMessage_Choice)(nil), (&oneofMessage{}).XXX_OneofWrappers()...)
+}
+
+var oneofMessages = []*oneofMessage{
+	&oneofMessage{},
+	&oneofMessage{ID: 1, Tail: "tail"},
+	&oneofMessage{Choice: &OneofMessage_Name{}},
+	&oneofMessage{Choice: &OneofMessage_Name{Name: "name"}},
+	&oneofMessage{Choice: &OneofMessage_Count{}},
+	&oneofMessage{Choice: &OneofMessage_Count{Count: -42}},
+	&oneofMessage{Choice: &OneofMessage_Data{Data: []byte("data")}},
+	&oneofMessage{Choice: &OneofMessage_Nested{Nested: &testproto.NestedStruct{}}},
+	&oneofMessage{ID: 1, Choice: &OneofMessage_Nested{Nested: &testproto.NestedStruct{Arg: 42}}, Tail: "tail"},
+}
+
+func TestOneofEncode(t *testing.T) {
+	t.Parallel()
+
+	for _, v := range oneofMessages {
+		data, err := Marshal(nil, v)
+		if err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+		pdata, err := proto.Marshal(v)
+		if err != nil {
+			t.Fatalf("marshal protobuf: %v", err)
+		}
+		if !bytes.Equal(pdata, data) {
+			t.Fatalf("oneof encode: expected bytes %q, got %q", pdata, data)
+		}
+		if n := sizeStruct(reflect.ValueOf(v).Elem()); n != len(data) {
+			t.Fatalf("oneof size: expected size %d, got %d", len(data), n)
+		}
+
+		m := &oneofMessage{}
+		if err = Unmarshal(data, m); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		if !reflect.DeepEqual(v, m) {
+			t.Fatalf("oneof decode: expected %#v, got %#v", v, m)
+		}
+	}
+}
+
+func TestOneofLastCaseWins(t *testing.T) {
+	t.Parallel()
+
+	var data []byte
+	for _, v := range oneofMessages[5:7] {
+		xdata, err := Marshal(nil, v)
+		if err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+		data = append(data, xdata...)
+	}
+
+	m := &oneofMessage{}
+	if err := Unmarshal(data, m); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(oneofMessages[6], m) {
+		t.Fatalf("oneof decode: expected %#v, got %#v", oneofMessages[6], m)
+	}
+}
+
+type unregisteredOneof struct {
+	Choice interface {
+		unregistered()
+	}
+}
+
+func TestOneofErrors(t *testing.T) {
+	t.Parallel()
+
+	if _, err := Marshal(nil, &unregisteredOneof{}); err == nil {
+		t.Fatalf("marshal unregistered oneof: expected error")
+	}
+	if _, err := Marshal(nil, &oneofMessage{Choice: (*OneofMessage_Name)(nil)}); err == nil {
+		t.Fatalf("marshal nil oneof wrapper: expected error")
+	}
+
+	for _, wrapper := range []interface{}{
+		OneofMessage_Name{},
+		(*testproto.NestedStruct)(nil),
+		(*struct{ A, B int32 })(nil),
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("register oneof %T: expected panic", wrapper)
+				}
+			}()
+			RegisterOneof((*isOneofMessage_Choice)(nil), wrapper)
+		}()
+	}
+}
+
+type isPointerOneof interface {
+	isPointerOneof()
+}
+
+type PointerOneof_Int struct {
+	Int *int32 `protobuf:"1"`
+}
+
+type PointerOneof_String struct {
+	String *string `protobuf:"2"`
+}
+
+type PointerOneof_Item struct {
+	Item *testItem `protobuf:"3"`
+}
+
+func (*PointerOneof_Int) isPointerOneof()    {}
+func (*PointerOneof_String) isPointerOneof() {}
+func (*PointerOneof_Item) isPointerOneof()   {}
+
+type pointerOneofMessage struct {
+	ID     uint64         `protobuf:"4"`
+	Choice isPointerOneof `protobuf_oneof:"choice"`
+}
+
+func init() {
+	RegisterOneof((*isPointerOneof)(nil),
+		(*PointerOneof_Int)(nil), (*PointerOneof_String)(nil), (*PointerOneof_Item)(nil))
+}
+
+func TestOneofNilPointer(t *testing.T) {
+	t.Parallel()
+
+	zero, empty := int32(0), ""
+	tests := []struct {
+		v, expected *pointerOneofMessage
+		data        []byte
+	}{
+		{
+			&pointerOneofMessage{Choice: &PointerOneof_Int{}},
+			&pointerOneofMessage{Choice: &PointerOneof_Int{Int: &zero}},
+			[]byte{1<<3 | wireVarint, 0},
+		},
+		{
+			&pointerOneofMessage{Choice: &PointerOneof_String{}},
+			&pointerOneofMessage{Choice: &PointerOneof_String{String: &empty}},
+			[]byte{2<<3 | wireBytes, 0},
+		},
+		{
+			&pointerOneofMessage{Choice: &PointerOneof_Item{}},
+			&pointerOneofMessage{Choice: &PointerOneof_Item{Item: &testItem{}}},
+			[]byte{3<<3 | wireBytes, 0},
+		},
+	}
+	for _, test := range tests {
+		data, err := Marshal(nil, test.v)
+		if err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+		if !bytes.Equal(test.data, data) {
+			t.Fatalf("oneof encode: expected bytes %v, got %v", test.data, data)
+		}
+		if n := sizeStruct(reflect.ValueOf(test.v).Elem()); n != len(data) {
+			t.Fatalf("oneof size: expected size %d, got %d", len(data), n)
+		}
+
+		m := &pointerOneofMessage{}
+		if err = (UnmarshalOptions{Strict: true}).Unmarshal(data, m); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		if !reflect.DeepEqual(test.expected, m) {
+			t.Fatalf("oneof decode: expected %#v, got %#v", test.expected, m)
+		}
+	}
+}
+
+type isCustomOneof interface {
+	isCustomOneof()
+}
+
+type CustomOneof_Time struct {
+	Time time.Time `protobuf:"1"`
+}
+
+type CustomOneof_Duration struct {
+	Duration time.Duration `protobuf:"2"`
+}
+
+type CustomOneof_ID struct {
+	ID testID `protobuf:"3"`
+}
+
+type CustomOneof_Amount struct {
+	Amount *big.Int `protobuf:"4"`
+}
+
+func (*CustomOneof_Time) isCustomOneof()     {}
+func (*CustomOneof_Duration) isCustomOneof() {}
+func (*CustomOneof_ID) isCustomOneof()       {}
+func (*CustomOneof_Amount) isCustomOneof()   {}
+
+type customOneofMessage struct {
+	Choice isCustomOneof `protobuf_oneof:"choice"`
+}
+
+func init() {
+	RegisterOneof((*isCustomOneof)(nil), (*CustomOneof_Time)(nil),
+		(*CustomOneof_Duration)(nil), (*CustomOneof_ID)(nil), (*CustomOneof_Amount)(nil))
+}
+
+func TestOneofZeroCustom(t *testing.T) {
+	t.Parallel()
+
+	tests := []*customOneofMessage{
+		{Choice: &CustomOneof_Time{}},
+		{Choice: &CustomOneof_Duration{}},
+		{Choice: &CustomOneof_ID{}},
+		{Choice: &CustomOneof_Amount{Amount: new(big.Int)}},
+	}
+	for _, v := range tests {
+		data, err := Marshal(nil, v)
+		if err != nil {
+			t.Fatalf("marshal %T: %v", v.Choice, err)
+		}
+		if n := sizeStruct(reflect.ValueOf(v).Elem()); n != len(data) {
+			t.Fatalf("size %T: expected %d, got %d", v.Choice, len(data), n)
+		}
+		m := &customOneofMessage{}
+		if err = (UnmarshalOptions{Strict: true}).Unmarshal(data, m); err != nil {
+			t.Fatalf("unmarshal %T: %v", v.Choice, err)
+		}
+		if c, ok := m.Choice.(*CustomOneof_Time); ok {
+			c.Time = c.Time.UTC()
+		}
+		if !reflect.DeepEqual(v, m) {
+			t.Fatalf("unmarshal %T: expected %#v, got %#v", v.Choice, v.Choice, m.Choice)
+		}
+	}
+
+	if _, err := Marshal(nil, &customOneofMessage{Choice: &CustomOneof_Amount{}}); err == nil {
+		t.Fatalf("marshal nil *big.Int: expected error")
+	}
+}
@@ -1,168 +1,424 @@
 package protobuf
 
 import (
-	"math"
 	"reflect"
 	"time"
 )
 
-func sizeStruct(val reflect.Value, fields int) (n int) {
+func sizeStruct(val reflect.Value) (n int) {
+	info := getStructInfo(val.Type())
+	if info.marshaler {
+		return sizeMarshaler(val)
+	}
 	var custom bool
 	var m int
-	for i := 0; i < fields; i++ {
-		field := val.Field(i)
-		if !field.CanSet() {
-			continue
-		}
+	for i := range info.fields {
+		f := &info.fields[i]
+		key := f.num
+		field := val.Field(f.index)
 
-		if custom, m = sizeCustom(field); custom {
+		if custom, m = sizeCustom(field, f); custom {
 			n += m
 			continue
 		}
+		if f.wrapped {
+			n += sizeWrapped(field, f)
+			continue
+		}
 
 		switch field.Kind() {
 		case reflect.Interface:
-			n += sizeSlice(field.Elem())
+			n += sizeOneof(field, f)
 		case reflect.Struct:
-			m = sizeStruct(field, field.NumField())
-			n += 1 + m + uvarintSize(uint64(m))
+			m = sizeStruct(field)
+			n += sizeKey(key) + m + uvarintSize(uint64(m))
 		case reflect.Ptr:
 			v := field.Elem()
 			switch v.Kind() {
 			case reflect.Struct:
-				m = sizeStruct(v, v.NumField())
-				n += 1 + m + uvarintSize(uint64(m))
+				m = sizeStruct(v)
+				n += sizeKey(key) + m + uvarintSize(uint64(m))
 			case reflect.Ptr:
 				// nothing
 			case reflect.Slice:
 				// nothing
 			default:
-				n += sizeType(v)
+				n += sizeValue(v, f)
 			}
 		case reflect.Slice:
-			n += sizeSlice(field)
+			n += sizeSlice(field, f)
+		case reflect.Array:
+			n += sizeArray(field, f)
+		case reflect.Map:
+			n += sizeMap(field, f)
 		default:
-			n += sizeType(field)
+			n += sizeType(field, f)
 		}
 	}
+	if info.unknown >= 0 {
+		n += val.Field(info.unknown).Len()
+	}
 	return n
 }
 
-func sizeCustom(val reflect.Value) (bool, int) {
+func sizeCustom(val reflect.Value, f *fieldInfo) (bool, int) {
+	if c := lookupCodec(val.Type()); c != nil {
+		if isZeroValue(val) {
+			return true, 0
+		}
+		return true, sizeCodec(f.num, c, val)
+	}
+	if val.Kind() == reflect.Ptr {
+		if c := lookupCodec(val.Type().Elem()); c != nil {
+			if val.IsNil() {
+				return true, 0
+			}
+			return true, sizeCodec(f.num, c, val.Elem())
+		}
+	}
+	if isValueTree(val.Type()) {
+		msg, err := valueTreeMessage(val)
+		if err != nil || msg == nil { // type errors are reported on encode
+			return true, 0
+		}
+		m := sizeStruct(reflect.ValueOf(msg).Elem())
+		return true, sizeKey(f.num) + m + uvarintSize(uint64(m))
+	}
+
 	itype := val.Interface()
 	if t, ok := itype.(error); ok || val.Type() == errorType {
 		if val.IsNil() {
 			return true, 0
 		}
 		v := len(t.Error())
-		return true, 1 + v + uvarintSize(uint64(v))
+		return true, sizeKey(f.num) + v + uvarintSize(uint64(v))
 	}
 	if t, ok := itype.(time.Time); ok {
 		if t.IsZero() {
 			return true, 0
 		}
-		return true, 1 + uvarintSize(uint64(t.UnixNano()))
+		return true, sizeTime(f, t)
+	}
+	if t, ok := itype.(*time.Time); ok {
+		if t == nil {
+			return true, 0
+		}
+		return true, sizeTime(f, *t)
+	}
+	if d, ok := itype.(time.Duration); ok {
+		if d == 0 {
+			return true, 0
+		}
+		return true, sizeDuration(f.num, d)
+	}
+	if d, ok := itype.(*time.Duration); ok {
+		if d == nil {
+			return true, 0
+		}
+		return true, sizeDuration(f.num, *d)
 	}
 	return false, 0
 }
 
-func sizeSlice(val reflect.Value) (n int) {
+// sizeTime returns the encoded size of the time t, including the key of
+// f, as written by writeTime.
+func sizeTime(f *fieldInfo, t time.Time) int {
+	if f.unixnano {
+		return sizeKey(f.num) + uvarintSize(uint64(t.UnixNano()))
+	}
+	ts, _ := newTimestamp(t) // range errors are reported on encode
+	m := sizeStruct(reflect.ValueOf(ts))
+	return sizeKey(f.num) + m + uvarintSize(uint64(m))
+}
+
+// sizeDuration returns the encoded size of the duration d, including
+// the key of the field number key.
+func sizeDuration(key int, d time.Duration) int {
+	m := sizeStruct(reflect.ValueOf(newDuration(d)))
+	return sizeKey(key) + m + uvarintSize(uint64(m))
+}
+
+func sizeSlice(val reflect.Value, f *fieldInfo) (n int) {
 	vlen := val.Len()
 	if vlen == 0 {
 		return 0
 	}
 
-	switch val.Type().Elem().Kind() {
-	case reflect.Int32, reflect.Int64:
+	ksize, kind := sizeKey(f.num), val.Type().Elem().Kind()
+	if c := lookupCodec(val.Type().Elem()); c != nil {
 		for i := 0; i < vlen; i++ {
-			n += 1 + uvarintSize(uint64(val.Index(i).Int()))
+			n += sizeCodec(f.num, c, val.Index(i))
 		}
-	case reflect.Uint32, reflect.Uint64:
+		return n
+	}
+	if t := val.Type().Elem(); t == timeType || t == timePtrType {
 		for i := 0; i < vlen; i++ {
-			n += 1 + uvarintSize(val.Index(i).Uint())
+			v := val.Index(i)
+			if t == timePtrType {
+				if v.IsNil() { // reported on encode
+					continue
+				}
+				v = v.Elem()
+			}
+			n += sizeTime(f, v.Interface().(time.Time))
 		}
-	case reflect.Float32:
+		return n
+	}
+	if t := val.Type().Elem(); t == durationType || t == durationPtrType {
 		for i := 0; i < vlen; i++ {
-			n += 5
+			v := val.Index(i)
+			if t == durationPtrType {
+				if v.IsNil() { // reported on encode
+					continue
+				}
+				v = v.Elem()
+			}
+			n += sizeDuration(f.num, time.Duration(v.Int()))
 		}
-	case reflect.Float64:
+		return n
+	}
+	if !f.unpacked && packable(kind) {
+		m := sizePacked(val, f)
+		return ksize + m + uvarintSize(uint64(m))
+	}
+
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		for i := 0; i < vlen; i++ {
-			n += 9
+			n += ksize + sizeInt(f, kind, f.intValue(val.Index(i).Int()))
 		}
-	case reflect.Bool:
+	case reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 		for i := 0; i < vlen; i++ {
-			n += 2
+			n += ksize + sizeInt(f, kind, val.Index(i).Uint())
 		}
+	case reflect.Float32:
+		n += vlen * (ksize + 4)
+	case reflect.Float64:
+		n += vlen * (ksize + 8)
+	case reflect.Bool:
+		n += vlen * (ksize + 1)
 	case reflect.String:
 		for i := 0; i < vlen; i++ {
 			m := len(val.Index(i).String())
-			n += 1 + m + uvarintSize(uint64(m))
+			n += ksize + m + uvarintSize(uint64(m))
 		}
 	case reflect.Uint8:
 		m := len(val.Bytes())
-		n += 1 + m + uvarintSize(uint64(m))
+		n += ksize + m + uvarintSize(uint64(m))
 	case reflect.Slice:
 		var v reflect.Value
 		for i := 0; i < vlen; i++ {
 			v = val.Index(i)
 			if v.Type().Elem().Kind() == reflect.Uint8 {
-				n += sizeSlice(v)
+				n += sizeSlice(v, f)
 			}
 		}
+	case reflect.Array:
+		for i := 0; i < vlen; i++ {
+			n += sizeValue(val.Index(i), f)
+		}
 	case reflect.Struct:
 		for i := 0; i < vlen; i++ {
-			m := sizeStruct(val.Index(i), val.Index(i).NumField())
-			n += 1 + m + uvarintSize(uint64(m))
+			m := sizeStruct(val.Index(i))
+			n += ksize + m + uvarintSize(uint64(m))
 		}
 	case reflect.Ptr:
 		for i := 0; i < vlen; i++ {
 			v := val.Index(i).Elem()
 			if v.Kind() == reflect.Struct {
-				m := sizeStruct(v, v.NumField())
-				n += 1 + m + uvarintSize(uint64(m))
+				m := sizeStruct(v)
+				n += ksize + m + uvarintSize(uint64(m))
 			}
 		}
 	}
 	return n
 }
 
-func sizeType(val reflect.Value) (n int) {
-	switch val.Kind() {
-	case reflect.Int32, reflect.Int64:
-		v := uint64(val.Int())
-		if v == 0 {
+func sizeArray(val reflect.Value, f *fieldInfo) int {
+	switch val.Type().Elem().Kind() {
+	case reflect.Uint8:
+		return sizeType(val, f)
+	case reflect.Struct, reflect.Ptr:
+		return sizeSlice(val, f)
+	}
+	if isZero(val) {
+		return 0
+	}
+	return sizeSlice(val, f)
+}
+
+func sizeWrapped(val reflect.Value, f *fieldInfo) int {
+	if val.IsNil() {
+		return 0
+	}
+	m := sizeStruct(wrapValue(val.Elem()))
+	return sizeKey(f.num) + m + uvarintSize(uint64(m))
+}
+
+func sizeOneof(val reflect.Value, f *fieldInfo) int {
+	if val.IsNil() {
+		return 0
+	}
+	c := f.oneofCase(val.Elem().Type())
+	if c == nil || val.Elem().IsNil() {
+		return 0
+	}
+
+	v := val.Elem().Elem().Field(c.inner)
+	if isNilMessage(v) {
+		return sizeKey(c.num) + 1
+	}
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		if lookupCodec(v.Type()) != nil { // reported on encode
 			return 0
 		}
-		n += 1 + uvarintSize(v)
-	case reflect.Uint32, reflect.Uint64:
-		v := val.Uint()
-		if v == 0 {
-			return 0
+		v = reflect.Zero(v.Type().Elem())
+	}
+	switch {
+	case lookupCodec(v.Type()) != nil:
+		return sizeCodec(c.num, lookupCodec(v.Type()), v)
+	case v.Type() == timeType:
+		return sizeTime(c, v.Interface().(time.Time))
+	case v.Type() == durationType:
+		return sizeDuration(c.num, time.Duration(v.Int()))
+	}
+	if custom, m := sizeCustom(v, c); custom {
+		return m
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		m := sizeStruct(v)
+		return sizeKey(c.num) + m + uvarintSize(uint64(m))
+	case reflect.Ptr:
+		if v.Elem().Kind() != reflect.Struct {
+			return sizeValue(v.Elem(), c)
 		}
-		n += 1 + uvarintSize(v)
-	case reflect.Float32:
-		if math.Float32bits(float32(val.Float())) == 0 {
-			return 0
+		m := sizeStruct(v.Elem())
+		return sizeKey(c.num) + m + uvarintSize(uint64(m))
+	}
+	return sizeValue(v, c)
+}
+
+func sizeMap(val reflect.Value, f *fieldInfo) (n int) {
+	ksize := sizeKey(f.num)
+	for _, k := range val.MapKeys() {
+		m := sizeMapEntry(k, val.MapIndex(k))
+		n += ksize + m + uvarintSize(uint64(m))
+	}
+	return n
+}
+
+// sizeMapEntry returns the size of the map entry message with the key k
+// and the value v.
+func sizeMapEntry(k, v reflect.Value) int {
+	n := sizeValue(k, &mapKeyField)
+	if c := lookupCodec(v.Type()); c != nil {
+		return n + sizeCodec(mapValueField.num, c, v)
+	}
+	if v.Type() == timeType {
+		return n + sizeTime(&mapValueField, v.Interface().(time.Time))
+	}
+	if v.Type() == timePtrType && !v.IsNil() {
+		return n + sizeTime(&mapValueField, v.Elem().Interface().(time.Time))
+	}
+	if v.Type() == durationType {
+		return n + sizeDuration(mapValueField.num, time.Duration(v.Int()))
+	}
+	if v.Type() == durationPtrType && !v.IsNil() {
+		return n + sizeDuration(mapValueField.num, time.Duration(v.Elem().Int()))
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		m := sizeStruct(v)
+		return n + sizeKey(mapValueField.num) + m + uvarintSize(uint64(m))
+	case reflect.Ptr:
+		m := 0
+		if !v.IsNil() {
+			m = sizeStruct(v.Elem())
 		}
-		n += 5
-	case reflect.Float64:
-		if math.Float64bits(val.Float()) == 0 {
-			return 0
+		return n + sizeKey(mapValueField.num) + m + uvarintSize(uint64(m))
+	}
+	return n + sizeValue(v, &mapValueField)
+}
+
+// sizePacked returns the size of the packed elements of the scalar slice
+// val without key and length.
+func sizePacked(val reflect.Value, f *fieldInfo) (n int) {
+	vlen := val.Len()
+	switch kind := val.Type().Elem().Kind(); kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		for i := 0; i < vlen; i++ {
+			n += sizeInt(f, kind, f.intValue(val.Index(i).Int()))
 		}
-		n += 9
-	case reflect.Bool:
-		if !val.Bool() {
-			return 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		for i := 0; i < vlen; i++ {
+			n += sizeInt(f, kind, val.Index(i).Uint())
 		}
-		n += 2
+	case reflect.Float32:
+		n = vlen * 4
+	case reflect.Float64:
+		n = vlen * 8
+	case reflect.Bool:
+		n = vlen
+	}
+	return n
+}
+
+func sizeType(val reflect.Value, f *fieldInfo) int {
+	if isZero(val) {
+		return 0
+	}
+	return sizeValue(val, f)
+}
+
+// sizeValue returns the encoded size of the scalar, string or bytes value
+// val including its key, even if it is the zero value.
+func sizeValue(val reflect.Value, f *fieldInfo) int {
+	key, kind := f.num, val.Kind()
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return sizeKey(key) + sizeInt(f, kind, f.intValue(val.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return sizeKey(key) + sizeInt(f, kind, val.Uint())
+	case reflect.Float32:
+		return sizeKey(key) + 4
+	case reflect.Float64:
+		return sizeKey(key) + 8
+	case reflect.Bool:
+		return sizeKey(key) + 1
 	case reflect.String:
-		m := len(val.String())
-		if m == 0 {
-			return 0
+		m := val.Len()
+		return sizeKey(key) + m + uvarintSize(uint64(m))
+	case reflect.Slice, reflect.Array:
+		if val.Type().Elem().Kind() == reflect.Uint8 {
+			m := val.Len()
+			return sizeKey(key) + m + uvarintSize(uint64(m))
 		}
-		n += 1 + m + uvarintSize(uint64(m))
 	}
-	return n
+	return 0
+}
+
+// sizeInt returns the encoded size of the integer v of the given kind
+// without its key.
+func sizeInt(f *fieldInfo, kind reflect.Kind, v uint64) int {
+	if f.fixed {
+		return fixedSize(kind)
+	}
+	return uvarintSize(v)
+}
+
+// fixedSize returns the fixed encoding width of an integer kind.
+func fixedSize(kind reflect.Kind) int {
+	switch kind {
+	case reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return 4
+	}
+	return 8
+}
+
+func sizeKey(key int) int {
+	return uvarintSize(uint64(key) << 3)
 }
 
 func uvarintSize(v uint64) (n int) {
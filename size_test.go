@@ -14,7 +14,7 @@ func TestTypeSize(t *testing.T) {
 		n := proto.Size(v)
 
 		val := reflect.ValueOf(v)
-		m := sizeStruct(val.Elem(), val.Elem().NumField())
+		m := sizeStruct(val.Elem())
 
 		if n != m {
 			t.Fatalf("type size: expected size %d, got %d", n, m)
@@ -29,7 +29,7 @@ func TestSliceSize(t *testing.T) {
 		n := proto.Size(v)
 
 		val := reflect.ValueOf(v)
-		m := sizeStruct(val.Elem(), val.Elem().NumField())
+		m := sizeStruct(val.Elem())
 
 		if n != m {
 			t.Fatalf("slice size: expected size %d, got %d", n, m)
@@ -44,7 +44,7 @@ func TestStructSize(t *testing.T) {
 		n := proto.Size(v)
 
 		val := reflect.ValueOf(v)
-		m := sizeStruct(val.Elem(), val.Elem().NumField())
+		m := sizeStruct(val.Elem())
 
 		if n != m {
 			t.Fatalf("struct size: expected size %d, got %d", n, m)
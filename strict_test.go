@@ -0,0 +1,140 @@
+package protobuf
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	testproto "github.com/mars9/protobuf/internal/proto"
+)
+
+func TestStrictRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	i64, u32, f64, b, s := int64(-7), uint32(7), 1.5, true, "abc"
+	d := -1500 * time.Millisecond
+	tests := []interface{}{
+		structMessages[len(structMessages)-1],
+		&testOrder{Items: []testItem{{"a", 1}}, Pointers: []*testItem{{"b", 2}}, ID: 3},
+		&zigzagMessage{Int32: -1, Int64: -2, Int32s: []int32{-3}, Int64s: []int64{-4}},
+		&fixedMessage{Uint32: 1, Uint64: 2, Int32: -3, Int64: -4,
+			Uint32s: []uint32{5}, Uint64s: []uint64{6}, Int32s: []int32{-7}, Int64s: []int64{-8}},
+		&presenceMessage{Int32: new(int32), Uint64: new(uint64), Float64: &f64, Bool: &b, String: &s},
+		&arrayMessage{ID: [16]byte{1}, Vector: [3]float64{1, 2, 3}, Counts: [4]int32{-1},
+			Names: [2]string{"a"}, Items: [2]testItem{{"a", 1}}, Hashes: [2][4]byte{{1}}, Parent: &[16]byte{2}},
+		&timeMessage{Time: time.Unix(1, 2).UTC()},
+		&legacyTimeMessage{Time: time.Unix(1, 2)},
+		&durationMessage{Duration: d, Timeout: &d},
+		&wrapperMessage{Int64: &i64, Uint32: &u32, Double: &f64, Bool: &b, String: &s},
+		&codecMessage{ID: 1, Refs: []testID{2}, Owners: map[string]testID{"a": 3},
+			Amount: big.NewInt(-4), Deltas: []*big.Int{big.NewInt(5)}},
+		&oneofMessage{ID: 1, Choice: &OneofMessage_Count{Count: -2}},
+		&valueMessage{Object: map[string]interface{}{"a": 1.0}, List: []interface{}{"b", true}, Value: nil},
+	}
+	for _, v := range tests {
+		data, err := Marshal(nil, v)
+		if err != nil {
+			t.Fatalf("marshal %T: %v", v, err)
+		}
+		m := reflect.New(reflect.TypeOf(v).Elem()).Interface()
+		if err = (UnmarshalOptions{Strict: true}).Unmarshal(data, m); err != nil {
+			t.Fatalf("unmarshal %T: %v", v, err)
+		}
+	}
+
+	for _, v := range structMessages {
+		data, err := proto.Marshal(v)
+		if err != nil {
+			t.Fatalf("marshal protobuf: %v", err)
+		}
+		if err = (UnmarshalOptions{Strict: true}).Unmarshal(data, &testproto.StructMessage{}); err != nil {
+			t.Fatalf("unmarshal protobuf: %v", err)
+		}
+	}
+}
+
+func TestStrictErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		data []byte
+		v    interface{}
+	}{
+		// fixed64 into a string
+		{[]byte{1<<3 | wireFixed64, 1, 2, 3, 4, 5, 6, 7, 8}, &testItem{}},
+		// bytes into an int32
+		{[]byte{2<<3 | wireBytes, 1, 1}, &testItem{}},
+		// varint into a fixed field
+		{[]byte{1<<3 | wireVarint, 1}, &fixedMessage{}},
+		// fixed32 into a varint slice
+		{[]byte{1<<3 | wireFixed32, 1, 2, 3, 4}, &limitMessage{}},
+		// group on a known field
+		{[]byte{1<<3 | wireStartGroup, 1<<3 | wireEndGroup}, &testItem{}},
+		// varint into a Duration message
+		{[]byte{1<<3 | wireVarint, 1}, &durationMessage{}},
+		// non-minimal bool
+		{[]byte{4<<3 | wireVarint, 0x81, 0}, &presenceMessage{}},
+		// non-minimal packed bool
+		{[]byte{7<<3 | wireBytes, 2, 0x80, 0}, &testproto.SliceMessage{}},
+		// varint into a bytes codec
+		{[]byte{1<<3 | wireVarint, 1}, &codecMessage{}},
+		{[]byte{4<<3 | wireBytes, 4, 2<<3 | wireVarint, 1, 1<<3 | wireBytes, 0}, &codecMessage{}},
+		{[]byte{3<<3 | wireVarint, 1}, &customOneofMessage{}},
+	}
+	for _, test := range tests {
+		v := reflect.New(reflect.TypeOf(test.v).Elem()).Interface()
+		if err := Unmarshal(test.data, v); err != nil {
+			t.Fatalf("unmarshal %v: expected lenient decoding, got %v", test.data, err)
+		}
+		err := UnmarshalOptions{Strict: true}.Unmarshal(test.data, test.v)
+		if _, ok := err.(*DecodeError); !ok {
+			t.Fatalf("unmarshal %v: expected *DecodeError, got %#v", test.data, err)
+		}
+	}
+
+	// padded keys, lengths and integers are valid
+	data := []byte{2<<3 | wireVarint | 0x80, 0, 0x87, 0, 1<<3 | wireBytes, 0x81, 0, 'a'}
+	m := &testItem{}
+	if err := (UnmarshalOptions{Strict: true}).Unmarshal(data, m); err != nil {
+		t.Fatalf("unmarshal padded: %v", err)
+	}
+	if expected := (&testItem{Sku: "a", Count: 7}); !reflect.DeepEqual(expected, m) {
+		t.Fatalf("unmarshal padded: expected %#v, got %#v", expected, m)
+	}
+
+	// mismatched codec fields are kept as unknown fields
+	data = []byte{5<<3 | wireVarint, 1, 3<<3 | wireFixed32, 1, 2, 3, 4}
+	u := &struct {
+		ID      testID        `protobuf:"5"`
+		Choice  isCustomOneof `protobuf_oneof:"choice"`
+		Unknown UnknownFields
+	}{}
+	if err := Unmarshal(data, u); err != nil {
+		t.Fatalf("unmarshal codec: %v", err)
+	}
+	if u.ID != 0 || u.Choice != nil || !bytes.Equal(u.Unknown, data) {
+		t.Fatalf("unmarshal codec: expected unknown %v, got %#v", data, u)
+	}
+
+	// trailing garbage is rejected in either mode
+	for _, trailing := range [][]byte{{0}, {2 << 3}, {1<<3 | wireBytes, 2, 'a'}, {0x80}} {
+		data := append([]byte{2 << 3, 1}, trailing...)
+		for _, strict := range []bool{false, true} {
+			err := UnmarshalOptions{Strict: strict}.Unmarshal(data, &testItem{})
+			if _, ok := err.(*DecodeError); !ok {
+				t.Fatalf("unmarshal %v: expected *DecodeError, got %#v", data, err)
+			}
+		}
+	}
+
+	data = []byte{2, 1<<3 | wireFixed64, 1}
+	dec := NewDecoder(bytes.NewBuffer(data), 0)
+	dec.SetOptions(UnmarshalOptions{Strict: true})
+	if err := dec.Decode(&testItem{}); !errors.Is(err, ErrInvalidWireType) {
+		t.Fatalf("decode: expected ErrInvalidWireType, got %v", err)
+	}
+}
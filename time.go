@@ -0,0 +1,101 @@
+package protobuf
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"time"
+)
+
+// Valid range of a google.protobuf.Timestamp, 0001-01-01T00:00:00Z to
+// 9999-12-31T23:59:59.999999999Z.
+const (
+	minTimestampSeconds = -62135596800
+	maxTimestampSeconds = 253402300799
+)
+
+var (
+	timeType    = reflect.TypeOf(time.Time{})
+	timePtrType = reflect.TypeOf((*time.Time)(nil))
+)
+
+// timestamp is the google.protobuf.Timestamp message, which encodes
+// time.Time values.
+type timestamp struct {
+	Seconds int64 `protobuf:"1"`
+	Nanos   int32 `protobuf:"2"`
+}
+
+func newTimestamp(t time.Time) (timestamp, error) {
+	ts := timestamp{Seconds: t.Unix(), Nanos: int32(t.Nanosecond())}
+	if err := ts.check(); err != nil {
+		return timestamp{}, err
+	}
+	return ts, nil
+}
+
+func (ts timestamp) check() error {
+	if ts.Seconds < minTimestampSeconds || ts.Seconds > maxTimestampSeconds {
+		return errors.New("timestamp out of range")
+	}
+	if ts.Nanos < 0 || ts.Nanos >= 1e9 {
+		return errors.New("invalid timestamp nanos")
+	}
+	return nil
+}
+
+// decodeTimestamp decodes the google.protobuf.Timestamp message data into
+// the time.Time val.
+func decodeTimestamp(val reflect.Value, data []byte, s *decodeState) error {
+	var ts timestamp
+	if err := decodeStruct(reflect.ValueOf(&ts).Elem(), data, s); err != nil {
+		return err
+	}
+	if err := ts.check(); err != nil {
+		return err
+	}
+	val.Set(reflect.ValueOf(time.Unix(ts.Seconds, int64(ts.Nanos))))
+	return nil
+}
+
+var (
+	durationType    = reflect.TypeOf(time.Duration(0))
+	durationPtrType = reflect.TypeOf((*time.Duration)(nil))
+)
+
+// duration is the google.protobuf.Duration message, which encodes
+// time.Duration values. Seconds and nanos have the same sign.
+type duration struct {
+	Seconds int64 `protobuf:"1"`
+	Nanos   int32 `protobuf:"2"`
+}
+
+func newDuration(d time.Duration) duration {
+	return duration{
+		Seconds: int64(d / time.Second),
+		Nanos:   int32(d % time.Second),
+	}
+}
+
+// decodeDuration decodes the google.protobuf.Duration message data into
+// the time.Duration val.
+func decodeDuration(val reflect.Value, data []byte, s *decodeState) error {
+	var d duration
+	if err := decodeStruct(reflect.ValueOf(&d).Elem(), data, s); err != nil {
+		return err
+	}
+	if d.Nanos <= -1e9 || d.Nanos >= 1e9 ||
+		d.Seconds > 0 && d.Nanos < 0 || d.Seconds < 0 && d.Nanos > 0 {
+		return errors.New("invalid duration nanos")
+	}
+	const maxSeconds = math.MaxInt64 / int64(time.Second)
+	if d.Seconds > maxSeconds || d.Seconds < -maxSeconds {
+		return errors.New("duration out of range")
+	}
+	ns := d.Seconds*int64(time.Second) + int64(d.Nanos)
+	if d.Seconds > 0 && ns < 0 || d.Seconds < 0 && ns > 0 {
+		return errors.New("duration out of range")
+	}
+	val.SetInt(ns)
+	return nil
+}
@@ -0,0 +1,309 @@
+package protobuf
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+)
+
+type timeMessage struct {
+	Time time.Time `protobuf:"1"`
+}
+
+type legacyTimeMessage struct {
+	Time time.Time `protobuf:"1,unixnano"`
+}
+
+func TestTimestampEncode(t *testing.T) {
+	t.Parallel()
+
+	for _, tm := range []time.Time{
+		time.Unix(0, 0),
+		time.Unix(1500000000, 123456789),
+		time.Unix(-1, 999999999),
+		time.Date(1, 1, 1, 0, 0, 0, 1, time.UTC),
+		time.Date(9999, 12, 31, 23, 59, 59, 999999999, time.UTC),
+	} {
+		v := &timeMessage{Time: tm}
+		data, err := Marshal(nil, v)
+		if err != nil {
+			t.Fatalf("marshal %v: %v", tm, err)
+		}
+		if n := sizeStruct(reflect.ValueOf(v).Elem()); n != len(data) {
+			t.Fatalf("timestamp %v: expected size %d, got %d", tm, len(data), n)
+		}
+
+		pb, err := ptypes.TimestampProto(tm)
+		if err != nil {
+			t.Fatalf("timestamp proto %v: %v", tm, err)
+		}
+		msg, err := proto.Marshal(pb)
+		if err != nil {
+			t.Fatalf("marshal protobuf: %v", err)
+		}
+		expected := append([]byte{1<<3 | wireBytes, byte(len(msg))}, msg...)
+		if !bytes.Equal(expected, data) {
+			t.Fatalf("timestamp %v: expected bytes %v, got %v", tm, expected, data)
+		}
+
+		m := &timeMessage{}
+		if err = Unmarshal(data, m); err != nil {
+			t.Fatalf("unmarshal %v: %v", tm, err)
+		}
+		if !m.Time.Equal(tm) {
+			t.Fatalf("timestamp: expected %v, got %v", tm, m.Time)
+		}
+	}
+
+	for _, tm := range []time.Time{
+		time.Date(0, 12, 31, 23, 59, 59, 0, time.UTC),
+		time.Date(10000, 1, 1, 0, 0, 0, 0, time.UTC),
+	} {
+		if _, err := Marshal(nil, &timeMessage{Time: tm}); err == nil {
+			t.Fatalf("marshal %v: expected error", tm)
+		}
+	}
+	if err := Unmarshal([]byte{1<<3 | wireBytes, 2, 2 << 3, 0xff}, &timeMessage{}); err == nil {
+		t.Fatalf("unmarshal invalid nanos: expected error")
+	}
+}
+
+func TestLegacyTimeEncode(t *testing.T) {
+	t.Parallel()
+
+	tm := time.Unix(1500000000, 123456789)
+	v := &legacyTimeMessage{Time: tm}
+	data, err := Marshal(nil, v)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if n := sizeStruct(reflect.ValueOf(v).Elem()); n != len(data) {
+		t.Fatalf("legacy time: expected size %d, got %d", len(data), n)
+	}
+	if data[0] != 1<<3|wireVarint {
+		t.Fatalf("legacy time: expected varint key, got %d", data[0])
+	}
+
+	// both encodings decode into either field
+	for _, m := range []interface{}{&timeMessage{}, &legacyTimeMessage{}} {
+		if err = Unmarshal(data, m); err != nil {
+			t.Fatalf("unmarshal %T: %v", m, err)
+		}
+		if got := reflect.ValueOf(m).Elem().Field(0).Interface().(time.Time); !got.Equal(tm) {
+			t.Fatalf("legacy time: expected %v, got %v", tm, got)
+		}
+	}
+	if data, err = Marshal(nil, &timeMessage{Time: tm}); err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	m := &legacyTimeMessage{}
+	if err = Unmarshal(data, m); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if !m.Time.Equal(tm) {
+		t.Fatalf("legacy time: expected %v, got %v", tm, m.Time)
+	}
+}
+
+type durationMessage struct {
+	Duration time.Duration  `protobuf:"1"`
+	Timeout  *time.Duration `protobuf:"2"`
+}
+
+func TestDurationEncode(t *testing.T) {
+	t.Parallel()
+
+	for _, d := range []time.Duration{
+		time.Nanosecond,
+		-time.Nanosecond,
+		1500 * time.Millisecond,
+		-1500 * time.Millisecond,
+		-time.Second,
+		math.MaxInt64,
+		math.MinInt64,
+	} {
+		v := &durationMessage{Duration: d}
+		data, err := Marshal(nil, v)
+		if err != nil {
+			t.Fatalf("marshal %v: %v", d, err)
+		}
+		if n := sizeStruct(reflect.ValueOf(v).Elem()); n != len(data) {
+			t.Fatalf("duration %v: expected size %d, got %d", d, len(data), n)
+		}
+
+		msg, err := proto.Marshal(ptypes.DurationProto(d))
+		if err != nil {
+			t.Fatalf("marshal protobuf: %v", err)
+		}
+		expected := append([]byte{1<<3 | wireBytes, byte(len(msg))}, msg...)
+		if !bytes.Equal(expected, data) {
+			t.Fatalf("duration %v: expected bytes %v, got %v", d, expected, data)
+		}
+
+		m := &durationMessage{}
+		if err = Unmarshal(data, m); err != nil {
+			t.Fatalf("unmarshal %v: %v", d, err)
+		}
+		if !reflect.DeepEqual(v, m) {
+			t.Fatalf("duration: expected %#v, got %#v", v, m)
+		}
+	}
+
+	var zero time.Duration
+	v := &durationMessage{Timeout: &zero}
+	data, err := Marshal(nil, v)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if expected := []byte{2<<3 | wireBytes, 0}; !bytes.Equal(expected, data) {
+		t.Fatalf("zero duration pointer: expected bytes %v, got %v", expected, data)
+	}
+	if n := sizeStruct(reflect.ValueOf(v).Elem()); n != len(data) {
+		t.Fatalf("zero duration pointer: expected size %d, got %d", len(data), n)
+	}
+	m := &durationMessage{}
+	if err = Unmarshal(data, m); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(v, m) {
+		t.Fatalf("zero duration pointer: expected %#v, got %#v", v, m)
+	}
+
+	for _, data := range [][]byte{
+		{1<<3 | wireBytes, 13, 1 << 3, 1, 2 << 3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 1}, // mixed signs
+		{1<<3 | wireBytes, 6, 2 << 3, 0x80, 0x94, 0xeb, 0xdc, 0x03},                                        // nanos >= 1e9
+		{1<<3 | wireBytes, 10, 1 << 3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f},               // seconds overflow
+	} {
+		if err = Unmarshal(data, &durationMessage{}); err == nil {
+			t.Fatalf("unmarshal %v: expected error", data)
+		}
+	}
+}
+
+type timeContainers struct {
+	Ptr      *time.Time            `protobuf:"1"`
+	Zero     *time.Time            `protobuf:"2"`
+	List     []time.Time           `protobuf:"3"`
+	Ptrs     []*time.Time          `protobuf:"4"`
+	Map      map[string]time.Time  `protobuf:"5"`
+	PtrMap   map[string]*time.Time `protobuf:"6"`
+	Array    [2]time.Time          `protobuf:"7"`
+	Nanos    []time.Time           `protobuf:"8,unixnano"`
+	NanosPtr *time.Time            `protobuf:"9,unixnano"`
+}
+
+type timeContainersMessage struct {
+	Times timeContainers `protobuf:"1"`
+}
+
+// utc sets the location of the times in m to UTC.
+func (m *timeContainers) utc() {
+	utc := func(t *time.Time) { *t = t.UTC() }
+	for _, p := range []*time.Time{m.Ptr, m.Zero, m.NanosPtr} {
+		if p != nil {
+			utc(p)
+		}
+	}
+	for i := range m.List {
+		utc(&m.List[i])
+	}
+	for _, p := range m.Ptrs {
+		utc(p)
+	}
+	for k, v := range m.Map {
+		m.Map[k] = v.UTC()
+	}
+	for _, p := range m.PtrMap {
+		utc(p)
+	}
+	for i := range m.Array {
+		utc(&m.Array[i])
+	}
+	for i := range m.Nanos {
+		utc(&m.Nanos[i])
+	}
+}
+
+func TestTimeContainers(t *testing.T) {
+	t.Parallel()
+
+	t1 := time.Date(2020, 5, 17, 10, 30, 0, 123, time.UTC)
+	t2 := time.Date(1969, 12, 31, 23, 59, 59, 0, time.UTC)
+	expected := &timeContainersMessage{Times: timeContainers{
+		Ptr:      &t1,
+		Zero:     &time.Time{},
+		List:     []time.Time{t1, {}, t2},
+		Ptrs:     []*time.Time{&t2, &t1},
+		Map:      map[string]time.Time{"a": t1, "zero": {}},
+		PtrMap:   map[string]*time.Time{"b": &t2},
+		Array:    [2]time.Time{{}, t2},
+		Nanos:    []time.Time{t1, t2},
+		NanosPtr: &t2,
+	}}
+	data, err := Marshal(nil, expected)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if n := sizeStruct(reflect.ValueOf(expected).Elem()); n != len(data) {
+		t.Fatalf("size: expected %d, got %d", len(data), n)
+	}
+
+	m := &timeContainersMessage{}
+	if err = (UnmarshalOptions{Strict: true}).Unmarshal(data, m); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	m.Times.utc()
+	if !reflect.DeepEqual(expected, m) {
+		t.Fatalf("unmarshal: expected %#v, got %#v", expected, m)
+	}
+}
+
+type durationContainers struct {
+	List   []time.Duration           `protobuf:"1"`
+	Ptrs   []*time.Duration          `protobuf:"2"`
+	Map    map[string]time.Duration  `protobuf:"3"`
+	PtrMap map[string]*time.Duration `protobuf:"4"`
+	Array  [2]time.Duration          `protobuf:"5"`
+}
+
+func TestDurationContainers(t *testing.T) {
+	t.Parallel()
+
+	d1, d2 := time.Second, -1500*time.Millisecond
+	expected := &durationContainers{
+		List:   []time.Duration{d1, 0, d2},
+		Ptrs:   []*time.Duration{&d2, &d1},
+		Map:    map[string]time.Duration{"a": d1, "zero": 0},
+		PtrMap: map[string]*time.Duration{"b": &d2},
+		Array:  [2]time.Duration{0, d2},
+	}
+	data, err := Marshal(nil, expected)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if n := sizeStruct(reflect.ValueOf(expected).Elem()); n != len(data) {
+		t.Fatalf("size: expected %d, got %d", len(data), n)
+	}
+	m := &durationContainers{}
+	if err = (UnmarshalOptions{Strict: true}).Unmarshal(data, m); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(expected, m) {
+		t.Fatalf("unmarshal: expected %#v, got %#v", expected, m)
+	}
+
+	// repeated google.protobuf.Duration {seconds: 1}, {nanos: 5}
+	data = []byte{1<<3 | wireBytes, 2, 1 << 3, 1, 1<<3 | wireBytes, 2, 2 << 3, 5}
+	m = &durationContainers{}
+	if err = (UnmarshalOptions{Strict: true}).Unmarshal(data, m); err != nil {
+		t.Fatalf("unmarshal protoc: %v", err)
+	}
+	if list := []time.Duration{time.Second, 5}; !reflect.DeepEqual(list, m.List) {
+		t.Fatalf("unmarshal protoc: expected %#v, got %#v", list, m.List)
+	}
+}
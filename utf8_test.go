@@ -0,0 +1,60 @@
+package protobuf
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type utf8Message struct {
+	Name   string           `protobuf:"1"`
+	Names  []string         `protobuf:"2"`
+	Counts map[string]int64 `protobuf:"3"`
+	Err    error            `protobuf:"4"`
+}
+
+func TestInvalidUTF8(t *testing.T) {
+	t.Parallel()
+
+	const invalid = "a\xffb"
+	tests := []*utf8Message{
+		{Name: invalid},
+		{Names: []string{"a", invalid}},
+		{Counts: map[string]int64{invalid: 1}},
+		{Err: errors.New(invalid)},
+	}
+	for _, v := range tests {
+		if _, err := Marshal(nil, v); !errors.Is(err, ErrInvalidUTF8) {
+			t.Fatalf("marshal %#v: expected ErrInvalidUTF8, got %v", v, err)
+		}
+		data, err := MarshalOptions{AllowInvalidUTF8: true}.Marshal(nil, v)
+		if err != nil {
+			t.Fatalf("marshal %#v: %v", v, err)
+		}
+
+		err = Unmarshal(data, &utf8Message{})
+		if _, ok := err.(*DecodeError); !ok || !errors.Is(err, ErrInvalidUTF8) {
+			t.Fatalf("unmarshal %#v: expected ErrInvalidUTF8, got %#v", v, err)
+		}
+		m := &utf8Message{}
+		if err = (UnmarshalOptions{AllowInvalidUTF8: true}).Unmarshal(data, m); err != nil {
+			t.Fatalf("unmarshal %#v: %v", v, err)
+		}
+		if !reflect.DeepEqual(v, m) {
+			t.Fatalf("unmarshal: expected %#v, got %#v", v, m)
+		}
+	}
+
+	v := &utf8Message{Name: "héllo", Names: []string{"日本"}, Counts: map[string]int64{"ü": 1}}
+	data, err := Marshal(nil, v)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	m := &utf8Message{}
+	if err = Unmarshal(data, m); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(v, m) {
+		t.Fatalf("unmarshal: expected %#v, got %#v", v, m)
+	}
+}
@@ -0,0 +1,247 @@
+package protobuf
+
+import (
+	"fmt"
+	"reflect"
+)
+
+var (
+	objectType = reflect.TypeOf(map[string]interface{}(nil))
+	listType   = reflect.TypeOf([]interface{}(nil))
+	valueType  = reflect.TypeOf((*interface{})(nil)).Elem()
+)
+
+// protoStruct, protoList and protoValue are the google.protobuf.Struct,
+// ListValue and Value messages, which encode map[string]interface{},
+// []interface{} and interface{} values.
+type protoStruct struct {
+	Fields map[string]*protoValue `protobuf:"1"`
+}
+
+type protoList struct {
+	Values []*protoValue `protobuf:"1"`
+}
+
+type protoValue struct {
+	Kind isProtoValueKind `protobuf_oneof:"kind"`
+}
+
+type isProtoValueKind interface{ isProtoValueKind() }
+
+type protoNullValue struct {
+	Null int32 `protobuf:"1"` // google.protobuf.NullValue
+}
+
+type protoNumberValue struct {
+	Number float64 `protobuf:"2"`
+}
+
+type protoStringValue struct {
+	String string `protobuf:"3"`
+}
+
+type protoBoolValue struct {
+	Bool bool `protobuf:"4"`
+}
+
+type protoStructValue struct {
+	Struct *protoStruct `protobuf:"5"`
+}
+
+type protoListValue struct {
+	List *protoList `protobuf:"6"`
+}
+
+func (*protoNullValue) isProtoValueKind()   {}
+func (*protoNumberValue) isProtoValueKind() {}
+func (*protoStringValue) isProtoValueKind() {}
+func (*protoBoolValue) isProtoValueKind()   {}
+func (*protoStructValue) isProtoValueKind() {}
+func (*protoListValue) isProtoValueKind()   {}
+
+func init() {
+	RegisterOneof((*isProtoValueKind)(nil),
+		(*protoNullValue)(nil), (*protoNumberValue)(nil),
+		(*protoStringValue)(nil), (*protoBoolValue)(nil),
+		(*protoStructValue)(nil), (*protoListValue)(nil))
+}
+
+// isValueTree reports whether values of the type t are encoded as
+// google.protobuf.Struct, ListValue or Value messages.
+func isValueTree(t reflect.Type) bool {
+	return t == objectType || t == listType || t == valueType
+}
+
+// valueTreeMessage returns the message, which encodes the
+// map[string]interface{}, []interface{} or interface{} value val. It
+// returns nil if val is empty and therefore omitted from the encoding.
+func valueTreeMessage(val reflect.Value) (interface{}, error) {
+	if val.IsNil() || val.Kind() != reflect.Interface && val.Len() == 0 {
+		return nil, nil
+	}
+	switch v := val.Interface().(type) {
+	case map[string]interface{}:
+		if val.Type() == objectType {
+			return newProtoStruct(v)
+		}
+	case []interface{}:
+		if val.Type() == listType {
+			return newProtoList(v)
+		}
+	}
+	return newProtoValue(val.Interface())
+}
+
+func newProtoStruct(m map[string]interface{}) (*protoStruct, error) {
+	s := &protoStruct{Fields: make(map[string]*protoValue, len(m))}
+	for k, v := range m {
+		pv, err := newProtoValue(v)
+		if err != nil {
+			return nil, err
+		}
+		s.Fields[k] = pv
+	}
+	return s, nil
+}
+
+func newProtoList(l []interface{}) (*protoList, error) {
+	pl := &protoList{Values: make([]*protoValue, len(l))}
+	for i, v := range l {
+		pv, err := newProtoValue(v)
+		if err != nil {
+			return nil, err
+		}
+		pl.Values[i] = pv
+	}
+	return pl, nil
+}
+
+// newProtoValue returns the Value message of v. Numbers are converted to
+// float64.
+func newProtoValue(v interface{}) (*protoValue, error) {
+	var kind isProtoValueKind
+	switch v := v.(type) {
+	case nil:
+		kind = &protoNullValue{}
+	case bool:
+		kind = &protoBoolValue{Bool: v}
+	case string:
+		kind = &protoStringValue{String: v}
+	case float64:
+		kind = &protoNumberValue{Number: v}
+	case float32:
+		kind = &protoNumberValue{Number: float64(v)}
+	case int, int8, int16, int32, int64:
+		kind = &protoNumberValue{Number: float64(reflect.ValueOf(v).Int())}
+	case uint, uint8, uint16, uint32, uint64:
+		kind = &protoNumberValue{Number: float64(reflect.ValueOf(v).Uint())}
+	case map[string]interface{}:
+		s, err := newProtoStruct(v)
+		if err != nil {
+			return nil, err
+		}
+		kind = &protoStructValue{Struct: s}
+	case []interface{}:
+		l, err := newProtoList(v)
+		if err != nil {
+			return nil, err
+		}
+		kind = &protoListValue{List: l}
+	default:
+		return nil, fmt.Errorf("unsupported value type %T", v)
+	}
+	return &protoValue{Kind: kind}, nil
+}
+
+// decodeValueTree decodes the google.protobuf.Struct, ListValue or Value
+// message data into the map[string]interface{}, []interface{} or
+// interface{} val and merges it with the current value of val.
+func decodeValueTree(val reflect.Value, data []byte, s *decodeState) error {
+	var v interface{}
+	switch val.Type() {
+	case objectType:
+		ps := &protoStruct{}
+		if err := decodeStruct(reflect.ValueOf(ps).Elem(), data, s); err != nil {
+			return err
+		}
+		v = ps.object()
+	case listType:
+		l := &protoList{}
+		if err := decodeStruct(reflect.ValueOf(l).Elem(), data, s); err != nil {
+			return err
+		}
+		v = l.list()
+	default:
+		pv := &protoValue{}
+		if err := decodeStruct(reflect.ValueOf(pv).Elem(), data, s); err != nil {
+			return err
+		}
+		if v = pv.value(); v == nil {
+			val.Set(reflect.Zero(val.Type()))
+			return nil
+		}
+	}
+	val.Set(reflect.ValueOf(mergeValue(val.Interface(), v)))
+	return nil
+}
+
+// mergeValue merges the decoded value tree v into the current value cur
+// the way protobuf merges Struct, ListValue and Value messages: objects
+// are merged by key, where values with the same key are replaced, lists
+// are concatenated and all other values are replaced.
+func mergeValue(cur, v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if m, ok := cur.(map[string]interface{}); ok && m != nil {
+			for k, x := range v {
+				m[k] = x
+			}
+			return m
+		}
+	case []interface{}:
+		if l, ok := cur.([]interface{}); ok {
+			return append(l, v...)
+		}
+	}
+	return v
+}
+
+func (s *protoStruct) object() map[string]interface{} {
+	m := make(map[string]interface{}, len(s.Fields))
+	for k, v := range s.Fields {
+		m[k] = v.value()
+	}
+	return m
+}
+
+func (l *protoList) list() []interface{} {
+	values := make([]interface{}, len(l.Values))
+	for i, v := range l.Values {
+		values[i] = v.value()
+	}
+	return values
+}
+
+// value returns the Go value of the Value message. Null and an unset
+// kind are nil.
+func (v *protoValue) value() interface{} {
+	switch k := v.Kind.(type) {
+	case *protoNumberValue:
+		return k.Number
+	case *protoStringValue:
+		return k.String
+	case *protoBoolValue:
+		return k.Bool
+	case *protoStructValue:
+		if k.Struct == nil {
+			return map[string]interface{}{}
+		}
+		return k.Struct.object()
+	case *protoListValue:
+		if k.List == nil {
+			return []interface{}{}
+		}
+		return k.List.list()
+	}
+	return nil
+}
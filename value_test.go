@@ -0,0 +1,106 @@
+package protobuf
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+)
+
+type valueMessage struct {
+	Object map[string]interface{} `protobuf:"1"`
+	List   []interface{}          `protobuf:"2"`
+	Value  interface{}            `protobuf:"3"`
+}
+
+type valueProtoMessage struct {
+	Object *structpb.Struct    `protobuf:"bytes,1,opt,name=object"`
+	List   *structpb.ListValue `protobuf:"bytes,2,opt,name=list"`
+	Value  *structpb.Value     `protobuf:"bytes,3,opt,name=value"`
+}
+
+func (m *valueProtoMessage) Reset()         { *m = valueProtoMessage{} }
+func (m *valueProtoMessage) String() string { return proto.CompactTextString(m) }
+func (*valueProtoMessage) ProtoMessage()    {}
+
+func TestValueEncode(t *testing.T) {
+	t.Parallel()
+
+	v := &valueMessage{
+		Object: map[string]interface{}{
+			"null":   nil,
+			"number": 1.5,
+			"string": "abc",
+			"bool":   false,
+			"object": map[string]interface{}{"nested": true},
+			"list":   []interface{}{0.0, "x", []interface{}{}},
+			"empty":  map[string]interface{}{},
+		},
+		List:  []interface{}{nil, -2.0, map[string]interface{}{"a": "b"}},
+		Value: "scalar",
+	}
+
+	data, err := Marshal(nil, v)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if n := sizeStruct(reflect.ValueOf(v).Elem()); n != len(data) {
+		t.Fatalf("value: expected size %d, got %d", len(data), n)
+	}
+
+	pm := &valueProtoMessage{}
+	if err = proto.Unmarshal(data, pm); err != nil {
+		t.Fatalf("unmarshal protobuf: %v", err)
+	}
+	if f := pm.Object.Fields["object"].GetStructValue().Fields["nested"]; !f.GetBoolValue() {
+		t.Fatalf("value: expected nested true, got %v", f)
+	}
+	if _, ok := pm.Object.Fields["null"].Kind.(*structpb.Value_NullValue); !ok {
+		t.Fatalf("value: expected null, got %v", pm.Object.Fields["null"])
+	}
+	if n := pm.List.Values[1].GetNumberValue(); n != -2 {
+		t.Fatalf("value: expected number %v, got %v", -2.0, n)
+	}
+	if s := pm.Value.GetStringValue(); s != "scalar" {
+		t.Fatalf("value: expected string %q, got %q", "scalar", s)
+	}
+
+	pdata, err := proto.Marshal(pm)
+	if err != nil {
+		t.Fatalf("marshal protobuf: %v", err)
+	}
+	for _, data := range [][]byte{data, pdata} {
+		m := &valueMessage{}
+		if err = Unmarshal(data, m); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		if !reflect.DeepEqual(v, m) {
+			t.Fatalf("value: expected %#v, got %#v", v, m)
+		}
+	}
+}
+
+func TestValueNumbers(t *testing.T) {
+	t.Parallel()
+
+	v := &valueMessage{List: []interface{}{int(1), int8(-2), uint64(3), float32(4.5)}}
+	data, err := Marshal(nil, v)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	m := &valueMessage{}
+	if err = Unmarshal(data, m); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if expected := []interface{}{1.0, -2.0, 3.0, 4.5}; !reflect.DeepEqual(expected, m.List) {
+		t.Fatalf("value numbers: expected %#v, got %#v", expected, m.List)
+	}
+
+	if _, err = Marshal(nil, &valueMessage{Value: struct{}{}}); err == nil {
+		t.Fatalf("marshal unsupported value: expected error")
+	}
+	if _, err = Marshal(nil, &valueMessage{Object: map[string]interface{}{"a": []int{1}}}); err == nil {
+		t.Fatalf("marshal unsupported value: expected error")
+	}
+}
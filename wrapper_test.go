@@ -0,0 +1,95 @@
+package protobuf
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/wrappers"
+)
+
+type wrapperMessage struct {
+	Int64  *int64   `protobuf:"1,wrapper"`
+	Uint32 *uint32  `protobuf:"2,wrapper"`
+	Double *float64 `protobuf:"3,wrapper"`
+	Bool   *bool    `protobuf:"4,wrapper"`
+	String *string  `protobuf:"5,wrapper"`
+	Bytes  *[]byte  `protobuf:"6,wrapper"`
+}
+
+func TestWrapperEncode(t *testing.T) {
+	t.Parallel()
+
+	var (
+		i64 int64 = -7
+		u32 uint32
+		f64 = 1.5
+		b   = true
+		s   = ""
+		bs  = []byte("abc")
+	)
+	v := &wrapperMessage{Int64: &i64, Uint32: &u32, Double: &f64, Bool: &b, String: &s, Bytes: &bs}
+
+	data, err := Marshal(nil, v)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if n := sizeStruct(reflect.ValueOf(v).Elem()); n != len(data) {
+		t.Fatalf("wrapper: expected size %d, got %d", len(data), n)
+	}
+
+	var expected []byte
+	for i, m := range []proto.Message{
+		&wrappers.Int64Value{Value: i64},
+		&wrappers.UInt32Value{Value: u32},
+		&wrappers.DoubleValue{Value: f64},
+		&wrappers.BoolValue{Value: b},
+		&wrappers.StringValue{Value: s},
+		&wrappers.BytesValue{Value: bs},
+	} {
+		msg, err := proto.Marshal(m)
+		if err != nil {
+			t.Fatalf("marshal protobuf: %v", err)
+		}
+		expected = append(expected, byte(i+1)<<3|wireBytes, byte(len(msg)))
+		expected = append(expected, msg...)
+	}
+	if !bytes.Equal(expected, data) {
+		t.Fatalf("wrapper: expected bytes %v, got %v", expected, data)
+	}
+
+	m := &wrapperMessage{}
+	if err = Unmarshal(data, m); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(v, m) {
+		t.Fatalf("wrapper: expected %#v, got %#v", v, m)
+	}
+
+	data, err = Marshal(nil, &wrapperMessage{})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if len(data) != 0 {
+		t.Fatalf("nil wrappers: expected no bytes, got %v", data)
+	}
+}
+
+type invalidWrapper struct {
+	Int64 int64 `protobuf:"1,wrapper"`
+}
+
+type invalidWrapperZigZag struct {
+	Int64 *int64 `protobuf:"1,wrapper,zigzag"`
+}
+
+func TestInvalidWrapper(t *testing.T) {
+	t.Parallel()
+
+	for _, v := range []interface{}{&invalidWrapper{}, &invalidWrapperZigZag{}} {
+		if _, err := Marshal(nil, v); err == nil {
+			t.Fatalf("marshal %T: expected error", v)
+		}
+	}
+}